@@ -0,0 +1,167 @@
+/*
+ * Teleport
+ * Copyright (C) 2024  Gravitational, Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package jobsv1 implements a small asynchronous job abstraction for RPCs
+// that mutate many resources at once (e.g. bulk bot creation), so that
+// callers get an immediate handle to poll instead of holding a single long
+// RPC open and losing per-item error reporting when one mutation fails.
+package jobsv1
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+)
+
+// State is the lifecycle state of a Job.
+type State string
+
+const (
+	// StateRunning means the job's worker is still processing items.
+	StateRunning State = "running"
+	// StateCompleted means every item was processed, with or without
+	// per-item errors (see Job.Errors).
+	StateCompleted State = "completed"
+)
+
+// Job is a handle to an asynchronous bulk operation. GUID encodes both the
+// job's Type and a unique resource ID, following the pattern
+// "<type>~<uuid>", so that a single GetJob handler can dispatch work (e.g.
+// looking up progress) by prefix alone.
+type Job struct {
+	// GUID uniquely identifies the job, e.g. "bot-bulk-create~<uuid>".
+	GUID string
+	// Type identifies the kind of job, e.g. "bot-bulk-create".
+	Type string
+	// State is the job's current lifecycle state.
+	State State
+	// Warnings holds non-fatal, per-item messages (e.g. "bot X already
+	// existed, skipped").
+	Warnings []string
+	// Errors holds per-item failure messages. A non-empty Errors slice does
+	// not change State away from StateCompleted: the job as a whole ran to
+	// completion even if some items failed.
+	Errors []string
+}
+
+const guidSeparator = "~"
+
+// NewGUID returns a new GUID for a job of the given type, following the
+// "<type>~<uuid>" convention.
+func NewGUID(jobType string) string {
+	return jobType + guidSeparator + uuid.NewString()
+}
+
+// JobTypeFromGUID extracts the job type prefix from a GUID produced by
+// NewGUID, without needing to look the job up first.
+func JobTypeFromGUID(guid string) (string, error) {
+	jobType, _, ok := strings.Cut(guid, guidSeparator)
+	if !ok || jobType == "" {
+		return "", trace.BadParameter("malformed job guid %q", guid)
+	}
+	return jobType, nil
+}
+
+// Store is an in-memory registry of in-flight and completed jobs. It does
+// not persist across process restarts; a GetJob call for a GUID from a
+// previous process returns NotFound, the same way it would for an unknown
+// GUID.
+type Store struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{jobs: make(map[string]*Job)}
+}
+
+// Start registers a new running job of the given type and returns a copy of
+// it, so later Finish calls don't change what the caller was handed.
+func (s *Store) Start(jobType string) *Job {
+	job := &Job{
+		GUID:  NewGUID(jobType),
+		Type:  jobType,
+		State: StateRunning,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.GUID] = job
+	clone := *job
+	return &clone
+}
+
+// Get returns the job with the given GUID, or NotFound if there isn't one.
+func (s *Store) Get(guid string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[guid]
+	if !ok {
+		return nil, trace.NotFound("job %q not found", guid)
+	}
+	// return a copy so callers can't mutate our bookkeeping by reference
+	clone := *job
+	return &clone, nil
+}
+
+// Finish marks the job identified by guid as completed, recording warnings
+// and errors gathered while processing it.
+func (s *Store) Finish(guid string, warnings, errs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[guid]
+	if !ok {
+		return
+	}
+	job.State = StateCompleted
+	job.Warnings = warnings
+	job.Errors = errs
+}
+
+// RunBounded calls fn once per item, with at most concurrency calls
+// in-flight at a time, collecting each call's error (if any) indexed by
+// item position. A zero or negative concurrency runs every item serially.
+func RunBounded[T any](ctx context.Context, concurrency int, items []T, fn func(context.Context, T) error) []error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	errs := make([]error, len(items))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, item := range items {
+		i, item := i, item
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(ctx, item)
+		}()
+	}
+
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,353 @@
+/*
+ * Teleport
+ * Copyright (C) 2024  Gravitational, Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package machineidv1
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/gravitational/teleport/api/gen/proto/go/teleport/machineid/v1"
+	"github.com/gravitational/teleport/api/types"
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/authz"
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// clientRemoteAddr returns the remote address of the peer making the gRPC
+// call, or "" if it can't be determined.
+func clientRemoteAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+// defaultBotInstanceHeartbeatTTL is how long a bot instance is kept around
+// after its last heartbeat before it's considered stale and reported as
+// expired. tbot is expected to heartbeat well within this window.
+const defaultBotInstanceHeartbeatTTL = 10 * time.Minute
+
+// defaultExpiryInterval is how often runExpiryLoop sweeps for stale bot
+// instances.
+const defaultExpiryInterval = time.Minute
+
+// BotInstanceBackend is the subset of the backend resources that
+// [BotInstanceService] modifies.
+type BotInstanceBackend interface {
+	// CreateBotInstance creates a bot instance, only if it does not already
+	// exist.
+	CreateBotInstance(ctx context.Context, instance *pb.BotInstance) (*pb.BotInstance, error)
+	// UpdateBotInstance updates an existing bot instance if revisions match.
+	UpdateBotInstance(ctx context.Context, instance *pb.BotInstance) (*pb.BotInstance, error)
+	// GetBotInstance returns a bot instance by bot name and instance ID.
+	GetBotInstance(ctx context.Context, botName, instanceID string) (*pb.BotInstance, error)
+	// ListBotInstances lists bot instances belonging to botName. An empty
+	// botName lists every instance of every bot.
+	ListBotInstances(ctx context.Context, botName string, pageSize int, pageToken string) ([]*pb.BotInstance, string, error)
+	// DeleteBotInstance deletes a single bot instance.
+	DeleteBotInstance(ctx context.Context, botName, instanceID string) error
+	// DeleteAllBotInstancesForBot deletes every instance belonging to
+	// botName; it's called when the bot itself is deleted.
+	DeleteAllBotInstancesForBot(ctx context.Context, botName string) error
+}
+
+// BotInstanceServiceConfig holds configuration options for the bot instance
+// gRPC service.
+type BotInstanceServiceConfig struct {
+	Authorizer authz.Authorizer
+	Backend    BotInstanceBackend
+	Logger     logrus.FieldLogger
+	Emitter    apievents.Emitter
+	Clock      clockwork.Clock
+	// HeartbeatTTL is how long an instance is kept around without a
+	// heartbeat before it's considered stale. Defaults to
+	// [defaultBotInstanceHeartbeatTTL].
+	HeartbeatTTL time.Duration
+	// ExpiryInterval is how often the background sweep for stale instances
+	// runs. Defaults to [defaultExpiryInterval].
+	ExpiryInterval time.Duration
+}
+
+// NewBotInstanceService returns a new instance of the BotInstanceService.
+func NewBotInstanceService(cfg BotInstanceServiceConfig) (*BotInstanceService, error) {
+	switch {
+	case cfg.Backend == nil:
+		return nil, trace.BadParameter("backend service is required")
+	case cfg.Authorizer == nil:
+		return nil, trace.BadParameter("authorizer is required")
+	case cfg.Emitter == nil:
+		return nil, trace.BadParameter("emitter is required")
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = logrus.WithField(trace.Component, "botinstance.service")
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clockwork.NewRealClock()
+	}
+	if cfg.HeartbeatTTL <= 0 {
+		cfg.HeartbeatTTL = defaultBotInstanceHeartbeatTTL
+	}
+	if cfg.ExpiryInterval <= 0 {
+		cfg.ExpiryInterval = defaultExpiryInterval
+	}
+
+	s := &BotInstanceService{
+		logger:       cfg.Logger,
+		authorizer:   cfg.Authorizer,
+		backend:      cfg.Backend,
+		emitter:      cfg.Emitter,
+		clock:        cfg.Clock,
+		heartbeatTTL: cfg.HeartbeatTTL,
+	}
+	go s.runExpiryLoop(context.Background(), cfg.ExpiryInterval)
+	return s, nil
+}
+
+// BotInstanceService implements the
+// teleport.machineid.v1.BotInstanceService RPC service. It tracks the live
+// tbot instances associated with each bot, so operators can see which
+// machines are consuming a given bot identity and detect stale or
+// decommissioned ones.
+type BotInstanceService struct {
+	pb.UnimplementedBotInstanceServiceServer
+
+	backend      BotInstanceBackend
+	authorizer   authz.Authorizer
+	logger       logrus.FieldLogger
+	emitter      apievents.Emitter
+	clock        clockwork.Clock
+	heartbeatTTL time.Duration
+}
+
+// RegisterBotInstance registers a newly-joined tbot instance for a bot.
+func (s *BotInstanceService) RegisterBotInstance(
+	ctx context.Context, req *pb.RegisterBotInstanceRequest,
+) (*pb.BotInstance, error) {
+	if _, err := authz.AuthorizeWithVerbs(
+		ctx, s.logger, s.authorizer, false, types.KindBotInstance, types.VerbCreate,
+	); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	switch {
+	case req.BotName == "":
+		return nil, trace.BadParameter("bot_name: must be non-empty")
+	case req.InstanceId == "":
+		return nil, trace.BadParameter("instance_id: must be non-empty")
+	}
+
+	now := s.clock.Now()
+	instance := &pb.BotInstance{
+		Kind:    types.KindBotInstance,
+		Version: types.V1,
+		Spec: &pb.BotInstanceSpec{
+			BotName:     req.BotName,
+			InstanceId:  req.InstanceId,
+			JoinMethod:  req.JoinMethod,
+			HostName:    req.HostName,
+			TbotVersion: req.TbotVersion,
+			Generation:  1,
+		},
+		Status: &pb.BotInstanceStatus{
+			LastHeartbeat: timestamppb.New(now),
+			RemoteAddr:    clientRemoteAddr(ctx),
+		},
+	}
+
+	created, err := s.backend.CreateBotInstance(ctx, instance)
+	if err != nil {
+		return nil, trace.Wrap(err, "creating bot instance")
+	}
+
+	if err := s.emitter.EmitAuditEvent(ctx, &apievents.BotInstanceRegister{
+		Metadata: apievents.Metadata{
+			Type: events.BotInstanceRegisterEvent,
+			Code: events.BotInstanceRegisterCode,
+		},
+		UserMetadata: authz.ClientUserMetadata(ctx),
+		ResourceMetadata: apievents.ResourceMetadata{
+			Name: req.BotName,
+		},
+		InstanceID: req.InstanceId,
+		JoinMethod: string(req.JoinMethod),
+	}); err != nil {
+		s.logger.WithError(err).Warn("Failed to emit BotInstanceRegister audit event.")
+	}
+
+	return created, nil
+}
+
+// Heartbeat records a liveness signal and the current cert generation for a
+// bot instance.
+func (s *BotInstanceService) Heartbeat(
+	ctx context.Context, req *pb.HeartbeatRequest,
+) (*pb.BotInstance, error) {
+	if _, err := authz.AuthorizeWithVerbs(
+		ctx, s.logger, s.authorizer, false, types.KindBotInstance, types.VerbUpdate,
+	); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	instance, err := s.backend.GetBotInstance(ctx, req.BotName, req.InstanceId)
+	if err != nil {
+		return nil, trace.Wrap(err, "fetching bot instance")
+	}
+
+	instance.Status.LastHeartbeat = timestamppb.New(s.clock.Now())
+	instance.Spec.Generation = req.Generation
+
+	updated, err := s.backend.UpdateBotInstance(ctx, instance)
+	if err != nil {
+		return nil, trace.Wrap(err, "updating bot instance")
+	}
+	return updated, nil
+}
+
+// ListBotInstances lists the instances of a bot.
+func (s *BotInstanceService) ListBotInstances(
+	ctx context.Context, req *pb.ListBotInstancesRequest,
+) (*pb.ListBotInstancesResponse, error) {
+	if _, err := authz.AuthorizeWithVerbs(
+		ctx, s.logger, s.authorizer, false, types.KindBotInstance, types.VerbList,
+	); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	instances, token, err := s.backend.ListBotInstances(ctx, req.BotName, int(req.PageSize), req.PageToken)
+	if err != nil {
+		return nil, trace.Wrap(err, "listing bot instances")
+	}
+
+	return &pb.ListBotInstancesResponse{
+		BotInstances:  instances,
+		NextPageToken: token,
+	}, nil
+}
+
+// GetBotInstance gets a single bot instance by bot name and instance ID.
+func (s *BotInstanceService) GetBotInstance(
+	ctx context.Context, req *pb.GetBotInstanceRequest,
+) (*pb.BotInstance, error) {
+	if _, err := authz.AuthorizeWithVerbs(
+		ctx, s.logger, s.authorizer, false, types.KindBotInstance, types.VerbRead,
+	); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	instance, err := s.backend.GetBotInstance(ctx, req.BotName, req.InstanceId)
+	if err != nil {
+		return nil, trace.Wrap(err, "fetching bot instance")
+	}
+	return instance, nil
+}
+
+// expireStaleInstance deletes instance and emits a BotInstanceExpire audit
+// event; expireStaleInstances calls it for each instance whose last
+// heartbeat is older than s.heartbeatTTL.
+func (s *BotInstanceService) expireStaleInstance(ctx context.Context, instance *pb.BotInstance) error {
+	if err := s.backend.DeleteBotInstance(ctx, instance.Spec.BotName, instance.Spec.InstanceId); err != nil {
+		return trace.Wrap(err, "deleting expired bot instance")
+	}
+
+	if err := s.emitter.EmitAuditEvent(ctx, &apievents.BotInstanceExpire{
+		Metadata: apievents.Metadata{
+			Type: events.BotInstanceExpireEvent,
+			Code: events.BotInstanceExpireCode,
+		},
+		ResourceMetadata: apievents.ResourceMetadata{
+			Name: instance.Spec.BotName,
+		},
+		InstanceID: instance.Spec.InstanceId,
+	}); err != nil {
+		s.logger.WithError(err).Warn("Failed to emit BotInstanceExpire audit event.")
+	}
+	return nil
+}
+
+// runExpiryLoop periodically sweeps for bot instances that have gone stale
+// (no heartbeat within s.heartbeatTTL) and expires them, so decommissioned
+// or crashed tbot instances don't linger forever in ListBotInstances.
+func (s *BotInstanceService) runExpiryLoop(ctx context.Context, interval time.Duration) {
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		if err := s.expireStaleInstances(ctx); err != nil {
+			s.logger.WithError(err).Warn("Failed to sweep for stale bot instances.")
+		}
+	}
+}
+
+// expireStaleInstances scans every bot instance and expires the ones whose
+// last heartbeat is older than s.heartbeatTTL.
+func (s *BotInstanceService) expireStaleInstances(ctx context.Context) error {
+	var pageToken string
+	for {
+		instances, nextToken, err := s.backend.ListBotInstances(ctx, "", 0, pageToken)
+		if err != nil {
+			return trace.Wrap(err, "listing bot instances")
+		}
+
+		for _, instance := range instances {
+			lastHeartbeat := instance.Status.LastHeartbeat.AsTime()
+			if s.clock.Now().Sub(lastHeartbeat) < s.heartbeatTTL {
+				continue
+			}
+			if err := s.expireStaleInstance(ctx, instance); err != nil {
+				s.logger.WithError(err).WithFields(logrus.Fields{
+					"bot.name":    instance.Spec.BotName,
+					"instance.id": instance.Spec.InstanceId,
+				}).Warn("Failed to expire stale bot instance.")
+			}
+		}
+
+		if nextToken == "" {
+			return nil
+		}
+		pageToken = nextToken
+	}
+}
+
+// InstanceCount returns the number of live instances for botName, for
+// BotService.GetBot to surface through pb.BotStatus. It returns zero without
+// error if the backend is unavailable so bot reads never fail just because
+// instance tracking isn't configured.
+func (s *BotInstanceService) InstanceCount(ctx context.Context, botName string) int32 {
+	if s == nil {
+		return 0
+	}
+	instances, _, err := s.backend.ListBotInstances(ctx, botName, 0, "")
+	if err != nil {
+		s.logger.WithError(err).WithField("bot.name", botName).Warn("Failed to count bot instances.")
+		return 0
+	}
+	return int32(len(instances))
+}
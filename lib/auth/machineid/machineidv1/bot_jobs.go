@@ -0,0 +1,241 @@
+/*
+ * Teleport
+ * Copyright (C) 2024  Gravitational, Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package machineidv1
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gravitational/trace"
+
+	headerv1 "github.com/gravitational/teleport/api/gen/proto/go/teleport/header/v1"
+	pb "github.com/gravitational/teleport/api/gen/proto/go/teleport/machineid/v1"
+	"github.com/gravitational/teleport/api/types"
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/auth/machineid/jobsv1"
+	"github.com/gravitational/teleport/lib/authz"
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// bulkBotConcurrency bounds how many bots a bulk job mutates at once, so a
+// single tctl bulk-apply neither serializes every mutation nor, at the other
+// extreme, fans out unbounded goroutines against the backend.
+const bulkBotConcurrency = 10
+
+const (
+	jobTypeBulkCreateBots = "bot-bulk-create"
+	jobTypeBulkDeleteBots = "bot-bulk-delete"
+	jobTypeRotateBots     = "bot-rotate"
+)
+
+func jobToProto(job *jobsv1.Job) *pb.Job {
+	return &pb.Job{
+		Guid:     job.GUID,
+		Type:     job.Type,
+		State:    string(job.State),
+		Warnings: job.Warnings,
+		Errors:   job.Errors,
+	}
+}
+
+// runBulkJob starts a job of jobType and asynchronously runs fn once per
+// item in names with bounded concurrency, recording per-item failures as
+// job errors. It returns the job's initial (running) state immediately.
+func (bs *BotService) runBulkJob(jobType string, names []string, fn func(ctx context.Context, name string) error) *pb.Job {
+	job := bs.jobs.Start(jobType)
+
+	go func() {
+		// detached from the originating request's context: the job must
+		// keep running after the RPC that started it returns.
+		ctx := context.Background()
+
+		errs := jobsv1.RunBounded(ctx, bulkBotConcurrency, names, fn)
+
+		var errStrings []string
+		for i, err := range errs {
+			if err != nil {
+				errStrings = append(errStrings, names[i]+": "+err.Error())
+			}
+		}
+		bs.jobs.Finish(job.GUID, nil, errStrings)
+	}()
+
+	return jobToProto(job)
+}
+
+// BulkCreateBots creates many bots at once, returning a Job immediately
+// rather than serializing individual CreateBot calls and losing atomic
+// error reporting across the batch.
+func (bs *BotService) BulkCreateBots(ctx context.Context, req *pb.BulkCreateBotsRequest) (*pb.Job, error) {
+	if _, err := bs.createBotAuthz(ctx); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	createdBy := authz.ClientUsername(ctx)
+	createdByMeta := authz.ClientUserMetadata(ctx)
+	job := bs.jobs.Start(jobTypeBulkCreateBots)
+
+	go func() {
+		ctx := context.Background()
+		errs := jobsv1.RunBounded(ctx, bulkBotConcurrency, req.Bots, func(ctx context.Context, bot *pb.Bot) error {
+			if err := validateBot(bot); err != nil {
+				return trace.Wrap(err, "validating bot")
+			}
+			bot, err := UpsertBot(ctx, bs.backend, bot, bs.clock.Now(), createdBy)
+			if err != nil {
+				return err
+			}
+			if err := bs.emitter.EmitAuditEvent(ctx, &apievents.BotCreate{
+				Metadata: apievents.Metadata{
+					Type: events.BotCreateEvent,
+					Code: events.BotCreateCode,
+				},
+				UserMetadata: createdByMeta,
+				ResourceMetadata: apievents.ResourceMetadata{
+					Name: bot.Metadata.Name,
+				},
+			}); err != nil {
+				bs.logger.WithError(err).Warn("Failed to emit BotCreate audit event.")
+			}
+			revision := bs.events.publish(pb.BotEventType_BOT_EVENT_TYPE_PUT, bot)
+			bs.recordRevision(ctx, bot.Metadata.Name, revision)
+			return nil
+		})
+
+		var errStrings []string
+		for i, err := range errs {
+			if err != nil {
+				errStrings = append(errStrings, req.Bots[i].GetMetadata().GetName()+": "+err.Error())
+			}
+		}
+		bs.jobs.Finish(job.GUID, nil, errStrings)
+	}()
+
+	return jobToProto(job), nil
+}
+
+// BulkDeleteBots deletes many bots at once, returning a Job immediately.
+func (bs *BotService) BulkDeleteBots(ctx context.Context, req *pb.BulkDeleteBotsRequest) (*pb.Job, error) {
+	if err := bs.deleteBotAuthz(ctx); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	deletedBy := authz.ClientUserMetadata(ctx)
+
+	job := bs.runBulkJob(jobTypeBulkDeleteBots, req.BotNames, func(ctx context.Context, name string) error {
+		if err := trace.NewAggregate(
+			trace.Wrap(bs.deleteBotUser(ctx, name), "deleting bot user"),
+			trace.Wrap(bs.deleteBotRole(ctx, name), "deleting bot role"),
+		); err != nil {
+			return err
+		}
+
+		if err := bs.emitter.EmitAuditEvent(ctx, &apievents.BotDelete{
+			Metadata: apievents.Metadata{
+				Type: events.BotDeleteEvent,
+				Code: events.BotDeleteCode,
+			},
+			UserMetadata: deletedBy,
+			ResourceMetadata: apievents.ResourceMetadata{
+				Name: name,
+			},
+		}); err != nil {
+			bs.logger.WithError(err).Warn("Failed to emit BotDelete audit event.")
+		}
+		bs.events.publish(pb.BotEventType_BOT_EVENT_TYPE_DELETE, &pb.Bot{
+			Metadata: &headerv1.Metadata{Name: name},
+		})
+		return nil
+	})
+	return job, nil
+}
+
+// RotateBots forces a certificate generation bump for many bots at once,
+// invalidating any certificates currently in the field for those bots.
+func (bs *BotService) RotateBots(ctx context.Context, req *pb.RotateBotsRequest) (*pb.Job, error) {
+	if _, err := authz.AuthorizeWithVerbs(
+		ctx, bs.logger, bs.authorizer, false, types.KindBot, types.VerbUpdate,
+	); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	rotatedBy := authz.ClientUserMetadata(ctx)
+
+	job := bs.runBulkJob(jobTypeRotateBots, req.BotNames, func(ctx context.Context, name string) error {
+		bot, err := bs.rotateBotGeneration(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		if err := bs.emitter.EmitAuditEvent(ctx, &apievents.BotUpdate{
+			Metadata: apievents.Metadata{
+				Type: events.BotUpdateEvent,
+				Code: events.BotUpdateCode,
+			},
+			UserMetadata: rotatedBy,
+			ResourceMetadata: apievents.ResourceMetadata{
+				Name: name,
+			},
+		}); err != nil {
+			bs.logger.WithError(err).Warn("Failed to emit BotUpdate audit event.")
+		}
+		revision := bs.events.publish(pb.BotEventType_BOT_EVENT_TYPE_PUT, bot)
+		bs.recordRevision(ctx, bot.Metadata.Name, revision)
+		return nil
+	})
+	return job, nil
+}
+
+func (bs *BotService) rotateBotGeneration(ctx context.Context, botName string) (*pb.Bot, error) {
+	user, err := bs.backend.GetUser(ctx, BotResourceName(botName), false)
+	if err != nil {
+		return nil, trace.Wrap(err, "fetching bot user")
+	}
+
+	meta := user.GetMetadata()
+	generation, _ := strconv.Atoi(meta.Labels[types.BotGenerationLabel])
+	meta.Labels[types.BotGenerationLabel] = strconv.Itoa(generation + 1)
+	user.SetMetadata(meta)
+
+	user, err = bs.backend.UpdateUser(ctx, user)
+	if err != nil {
+		return nil, trace.Wrap(err, "updating bot user generation")
+	}
+
+	role, err := bs.backend.GetRole(ctx, BotResourceName(botName))
+	if err != nil {
+		return nil, trace.Wrap(err, "fetching bot role")
+	}
+
+	bot, err := botFromUserAndRole(user, role)
+	return bot, trace.Wrap(err, "converting from resources")
+}
+
+// GetJob returns the current state of a previously-started job.
+func (bs *BotService) GetJob(ctx context.Context, req *pb.GetJobRequest) (*pb.Job, error) {
+	if _, err := authz.AuthorizeWithVerbs(
+		ctx, bs.logger, bs.authorizer, false, types.KindBot, types.VerbRead,
+	); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	job, err := bs.jobs.Get(req.Guid)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return jobToProto(job), nil
+}
@@ -0,0 +1,228 @@
+/*
+ * Teleport
+ * Copyright (C) 2024  Gravitational, Inc.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package machineidv1
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravitational/trace"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/gravitational/teleport/api/gen/proto/go/teleport/machineid/v1"
+	"github.com/gravitational/teleport/api/types"
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/authz"
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// LockBot creates a lock targeting a bot's user, and optionally one of its
+// instances, so a security responder has a single well-audited action to
+// freeze a machine identity believed to be compromised instead of
+// hand-rolling `tctl lock --user=bot-<name>`.
+func (bs *BotService) LockBot(ctx context.Context, req *pb.LockBotRequest) (*pb.BotLock, error) {
+	authCtx, err := authz.AuthorizeWithVerbs(
+		ctx, bs.logger, bs.authorizer, false, types.KindLock, types.VerbCreate,
+	)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := authz.AuthorizeAdminAction(ctx, authCtx); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if req.BotName == "" {
+		return nil, trace.BadParameter("bot_name: must be non-empty")
+	}
+
+	target := types.LockTarget{
+		User:          BotResourceName(req.BotName),
+		BotInstanceID: req.BotInstanceId,
+	}
+
+	var expires *time.Time
+	if req.Expires != nil {
+		t := req.Expires.AsTime()
+		expires = &t
+	}
+
+	lock, err := types.NewLock(uuid.NewString(), types.LockSpecV2{
+		Target:  target,
+		Message: req.Message,
+		Expires: expires,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err, "building lock")
+	}
+
+	if err := bs.backend.UpsertLock(ctx, lock); err != nil {
+		return nil, trace.Wrap(err, "creating lock")
+	}
+
+	if err := bs.emitter.EmitAuditEvent(ctx, &apievents.BotLock{
+		Metadata: apievents.Metadata{
+			Type: events.BotLockEvent,
+			Code: events.BotLockCode,
+		},
+		UserMetadata: authz.ClientUserMetadata(ctx),
+		ResourceMetadata: apievents.ResourceMetadata{
+			Name: req.BotName,
+		},
+		LockName:      lock.GetName(),
+		BotInstanceID: req.BotInstanceId,
+	}); err != nil {
+		bs.logger.WithError(err).Warn("Failed to emit BotLock audit event.")
+	}
+
+	return botLockToProto(lock, req.BotName), nil
+}
+
+// UnlockBot removes a lock previously created by LockBot (or by `tctl lock`
+// against the same bot user) by name.
+func (bs *BotService) UnlockBot(ctx context.Context, req *pb.UnlockBotRequest) (*emptypb.Empty, error) {
+	authCtx, err := authz.AuthorizeWithVerbs(
+		ctx, bs.logger, bs.authorizer, false, types.KindLock, types.VerbDelete,
+	)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := authz.AuthorizeAdminAction(ctx, authCtx); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if req.Name == "" {
+		return nil, trace.BadParameter("name: must be non-empty")
+	}
+
+	botName, err := bs.lockBotName(ctx, req.Name)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if req.BotName != "" && req.BotName != botName {
+		return nil, trace.BadParameter("lock %q does not target bot %q", req.Name, req.BotName)
+	}
+
+	if err := bs.backend.DeleteLock(ctx, req.Name); err != nil {
+		return nil, trace.Wrap(err, "deleting lock")
+	}
+
+	if err := bs.emitter.EmitAuditEvent(ctx, &apievents.BotUnlock{
+		Metadata: apievents.Metadata{
+			Type: events.BotUnlockEvent,
+			Code: events.BotUnlockCode,
+		},
+		UserMetadata: authz.ClientUserMetadata(ctx),
+		ResourceMetadata: apievents.ResourceMetadata{
+			Name: botName,
+		},
+		LockName: req.Name,
+	}); err != nil {
+		bs.logger.WithError(err).Warn("Failed to emit BotUnlock audit event.")
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+// lockBotName returns the bot name targeted by lockName, or a NotFound/
+// BadParameter error if the lock doesn't exist or doesn't target a bot
+// user - UnlockBot's guard against deleting an arbitrary, non-bot lock by
+// name.
+func (bs *BotService) lockBotName(ctx context.Context, lockName string) (string, error) {
+	locks, err := bs.backend.GetLocks(ctx, false)
+	if err != nil {
+		return "", trace.Wrap(err, "listing locks")
+	}
+
+	for _, lock := range locks {
+		if lock.GetName() != lockName {
+			continue
+		}
+		user, err := bs.backend.GetUser(ctx, lock.Target().User, false)
+		if err != nil {
+			return "", trace.Wrap(err, "fetching lock target user")
+		}
+		botName, isBot := user.GetLabel(types.BotLabel)
+		if !isBot {
+			return "", trace.BadParameter("lock %q does not target a bot", lockName)
+		}
+		return botName, nil
+	}
+
+	return "", trace.NotFound("lock %q not found", lockName)
+}
+
+// ListBotLocks lists the locks currently targeting a bot's user.
+func (bs *BotService) ListBotLocks(ctx context.Context, req *pb.ListBotLocksRequest) (*pb.ListBotLocksResponse, error) {
+	if _, err := authz.AuthorizeWithVerbs(
+		ctx, bs.logger, bs.authorizer, false, types.KindLock, types.VerbRead, types.VerbList,
+	); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if req.BotName == "" {
+		return nil, trace.BadParameter("bot_name: must be non-empty")
+	}
+
+	locks, err := bs.backend.GetLocks(ctx, false, types.LockTarget{User: BotResourceName(req.BotName)})
+	if err != nil {
+		return nil, trace.Wrap(err, "listing bot locks")
+	}
+
+	resp := &pb.ListBotLocksResponse{}
+	for _, lock := range locks {
+		resp.Locks = append(resp.Locks, botLockToProto(lock, req.BotName))
+	}
+	return resp, nil
+}
+
+// purgeBotLocks best-effort deletes every lock targeting botName's user, for
+// DeleteBot's PurgeLocks option. Failures are logged rather than returned, the
+// same way bot instance cleanup is, so a stuck lock doesn't prevent the bot
+// itself from being deleted.
+func (bs *BotService) purgeBotLocks(ctx context.Context, botName string) {
+	locks, err := bs.backend.GetLocks(ctx, false, types.LockTarget{User: BotResourceName(botName)})
+	if err != nil {
+		bs.logger.WithError(err).WithField("bot.name", botName).Warn("Failed to list bot locks for purge.")
+		return
+	}
+	for _, lock := range locks {
+		if err := bs.backend.DeleteLock(ctx, lock.GetName()); err != nil {
+			bs.logger.WithError(err).WithField("bot.name", botName).WithField("lock.name", lock.GetName()).
+				Warn("Failed to purge bot lock.")
+		}
+	}
+}
+
+// botLockToProto converts a lock targeting botName into its BotService
+// representation. botName is passed in rather than derived from the lock's
+// target, since the target only carries the mangled bot user name.
+func botLockToProto(lock types.Lock, botName string) *pb.BotLock {
+	bl := &pb.BotLock{
+		Name:          lock.GetName(),
+		BotName:       botName,
+		BotInstanceId: lock.Target().BotInstanceID,
+		Message:       lock.Message(),
+	}
+	if expires := lock.LockExpiry(); expires != nil {
+		bl.Expires = timestamppb.New(*expires)
+	}
+	return bl
+}
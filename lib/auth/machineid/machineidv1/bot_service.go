@@ -21,6 +21,8 @@ package machineidv1
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -33,6 +35,7 @@ import (
 	pb "github.com/gravitational/teleport/api/gen/proto/go/teleport/machineid/v1"
 	"github.com/gravitational/teleport/api/types"
 	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/auth/machineid/jobsv1"
 	"github.com/gravitational/teleport/lib/authz"
 	"github.com/gravitational/teleport/lib/events"
 	usagereporter "github.com/gravitational/teleport/lib/usagereporter/teleport"
@@ -52,6 +55,11 @@ var SupportedJoinMethods = []types.JoinMethod{
 	types.JoinMethodToken,
 }
 
+// listBotsRoleFetchConcurrency bounds how many bot roles ListBots fetches
+// concurrently, so a large page of bots doesn't open an unbounded number of
+// in-flight cache reads.
+const listBotsRoleFetchConcurrency = 10
+
 // BotResourceName returns the default name for resources associated with the
 // given named bot.
 func BotResourceName(botName string) string {
@@ -94,6 +102,14 @@ type Backend interface {
 	GetRole(ctx context.Context, name string) (types.Role, error)
 	// GetToken returns a token by name.
 	GetToken(ctx context.Context, name string) (types.ProvisionToken, error)
+	// UpsertLock creates a new lock or forcefully updates an existing lock.
+	UpsertLock(ctx context.Context, lock types.Lock) error
+	// DeleteLock deletes a lock by name.
+	DeleteLock(ctx context.Context, name string) error
+	// GetLocks lists locks matching any of targets, or every lock if no
+	// targets are given. inForceOnly restricts the result to locks that
+	// haven't expired.
+	GetLocks(ctx context.Context, inForceOnly bool, targets ...types.LockTarget) ([]types.Lock, error)
 }
 
 // BotServiceConfig holds configuration options for
@@ -106,6 +122,10 @@ type BotServiceConfig struct {
 	Emitter    apievents.Emitter
 	Reporter   usagereporter.UsageReporter
 	Clock      clockwork.Clock
+	// Instances is optional; if set, GetBot surfaces the bot's instance
+	// count and DeleteBot cleans up the bot's instances. ListBots does not
+	// report instance counts.
+	Instances *BotInstanceService
 }
 
 // NewBotService returns a new instance of the BotService.
@@ -130,7 +150,7 @@ func NewBotService(cfg BotServiceConfig) (*BotService, error) {
 		cfg.Clock = clockwork.NewRealClock()
 	}
 
-	return &BotService{
+	bs := &BotService{
 		logger:     cfg.Logger,
 		authorizer: cfg.Authorizer,
 		cache:      cfg.Cache,
@@ -138,7 +158,76 @@ func NewBotService(cfg BotServiceConfig) (*BotService, error) {
 		emitter:    cfg.Emitter,
 		reporter:   cfg.Reporter,
 		clock:      cfg.Clock,
-	}, nil
+		instances:  cfg.Instances,
+		events:     newBotEventBuffer(),
+		jobs:       jobsv1.NewStore(),
+	}
+	bs.events.bootstrapRevision(bootstrapBotRevision(context.Background(), cfg.Cache, cfg.Logger))
+	go bs.runCompactionLoop(context.Background(), defaultCompactionInterval)
+	return bs, nil
+}
+
+// bootstrapBotRevision scans every bot user for its persisted
+// botRevisionLabel and returns the highest value found, or zero if none
+// carry one yet (a fresh cluster, or one upgrading from a build that
+// predates this label). NewBotService feeds the result to
+// [botEventBuffer.bootstrapRevision] so a restarted process, or a
+// freshly-elected replica behind a load balancer, doesn't hand out
+// revisions that collide with, or regress behind, ones another replica has
+// already streamed to watchers.
+func bootstrapBotRevision(ctx context.Context, cache Cache, logger logrus.FieldLogger) int64 {
+	var highest int64
+	pageToken := ""
+	for {
+		users, nextToken, err := cache.ListUsers(ctx, 0, pageToken, false)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to list bot users while bootstrapping event revision; starting from zero.")
+			return highest
+		}
+		for _, u := range users {
+			label, ok := u.GetLabel(botRevisionLabel)
+			if !ok {
+				continue
+			}
+			rev, err := strconv.ParseInt(label, 10, 64)
+			if err != nil {
+				continue
+			}
+			if rev > highest {
+				highest = rev
+			}
+		}
+		if nextToken == "" {
+			break
+		}
+		pageToken = nextToken
+	}
+	return highest
+}
+
+// recordRevision best-effort persists revision onto botName's user resource
+// via botRevisionLabel, so a later NewBotService bootstrap can recover it.
+// A failure here only delays that bootstrap catching up to the latest
+// revision - it never affects the mutation or event delivery that already
+// succeeded - so it's logged and swallowed rather than surfaced to the
+// caller.
+func (bs *BotService) recordRevision(ctx context.Context, botName string, revision int64) {
+	user, err := bs.backend.GetUser(ctx, BotResourceName(botName), false)
+	if err != nil {
+		bs.logger.WithError(err).WithField("bot.name", botName).Warn("Failed to fetch bot user to record event revision.")
+		return
+	}
+
+	meta := user.GetMetadata()
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	meta.Labels[botRevisionLabel] = strconv.FormatInt(revision, 10)
+	user.SetMetadata(meta)
+
+	if _, err := bs.backend.UpdateUser(ctx, user); err != nil {
+		bs.logger.WithError(err).WithField("bot.name", botName).Warn("Failed to record event revision on bot user.")
+	}
 }
 
 // BotService implements the teleport.machineid.v1.BotService RPC service.
@@ -152,6 +241,9 @@ type BotService struct {
 	emitter    apievents.Emitter
 	reporter   usagereporter.UsageReporter
 	clock      clockwork.Clock
+	instances  *BotInstanceService
+	events     *botEventBuffer
+	jobs       *jobsv1.Store
 }
 
 // GetBot gets a bot by name. It will throw an error if the bot does not exist.
@@ -180,6 +272,7 @@ func (bs *BotService) GetBot(ctx context.Context, req *pb.GetBotRequest) (*pb.Bo
 	if err != nil {
 		return nil, trace.Wrap(err, "converting from resources")
 	}
+	bot.Status.InstanceCount = bs.instances.InstanceCount(ctx, bot.Metadata.Name)
 
 	return bot, nil
 }
@@ -195,33 +288,50 @@ func (bs *BotService) ListBots(
 		return nil, trace.Wrap(err)
 	}
 
-	// TODO(noah): Rewrite this to be less janky/better performing.
-	// - Concurrency for fetching roles
-	bots := []*pb.Bot{}
 	users, token, err := bs.cache.ListUsers(
 		ctx, int(req.PageSize), req.PageToken, false,
 	)
 	if err != nil {
 		return nil, trace.Wrap(err, "listing users")
 	}
+
+	type botUser struct {
+		index   int
+		user    types.User
+		botName string
+	}
+	var botUsers []botUser
 	for _, u := range users {
 		botName, isBot := u.GetLabel(types.BotLabel)
 		if !isBot {
 			continue
 		}
+		botUsers = append(botUsers, botUser{index: len(botUsers), user: u, botName: botName})
+	}
 
-		role, err := bs.cache.GetRole(ctx, BotResourceName(botName))
+	roles := make([]types.Role, len(botUsers))
+	errs := jobsv1.RunBounded(ctx, listBotsRoleFetchConcurrency, botUsers, func(ctx context.Context, bu botUser) error {
+		role, err := bs.cache.GetRole(ctx, BotResourceName(bu.botName))
 		if err != nil {
+			return err
+		}
+		roles[bu.index] = role
+		return nil
+	})
+
+	bots := []*pb.Bot{}
+	for i, bu := range botUsers {
+		if err := errs[i]; err != nil {
 			bs.logger.WithError(err).WithFields(logrus.Fields{
-				"bot.name": botName,
+				"bot.name": bu.botName,
 			}).Warn("Failed to fetch role for bot during ListBots. Bot will be omitted from results.")
 			continue
 		}
 
-		bot, err := botFromUserAndRole(u, role)
+		bot, err := botFromUserAndRole(bu.user, roles[i])
 		if err != nil {
 			bs.logger.WithError(err).WithFields(logrus.Fields{
-				"bot.name": botName,
+				"bot.name": bu.botName,
 			}).Warn("Failed to convert bot during ListBots. Bot will be omitted from results.")
 			continue
 		}
@@ -324,6 +434,8 @@ func (bs *BotService) CreateBot(
 	}); err != nil {
 		bs.logger.WithError(err).Warn("Failed to emit BotCreate audit event.")
 	}
+	revision := bs.events.publish(pb.BotEventType_BOT_EVENT_TYPE_PUT, bot)
+	bs.recordRevision(ctx, bot.Metadata.Name, revision)
 
 	return bot, nil
 }
@@ -414,6 +526,8 @@ func (bs *BotService) UpsertBot(ctx context.Context, req *pb.UpsertBotRequest) (
 	}); err != nil {
 		bs.logger.WithError(err).Warn("Failed to emit BotCreate audit event.")
 	}
+	revision := bs.events.publish(pb.BotEventType_BOT_EVENT_TYPE_PUT, bot)
+	bs.recordRevision(ctx, bot.Metadata.Name, revision)
 
 	return bot, nil
 }
@@ -464,17 +578,14 @@ func (bs *BotService) UpdateBot(
 				Roles: req.Bot.Spec.Roles,
 			})
 		case path == "spec.traits":
-			traits := map[string][]string{}
-			for _, t := range req.Bot.Spec.Traits {
-				if len(t.Values) == 0 {
-					continue
-				}
-				if traits[t.Name] == nil {
-					traits[t.Name] = []string{}
-				}
-				traits[t.Name] = append(traits[t.Name], t.Values...)
-			}
-			user.SetTraits(traits)
+			_, customTraits := splitBotTraits(user)
+			setBotTraits(user, traitsFromProto(req.Bot.Spec.Traits), customTraits)
+		case path == "spec.custom_roles":
+			resourceName := BotResourceName(req.Bot.Metadata.Name)
+			user.SetRoles(append([]string{resourceName}, req.Bot.Spec.CustomRoles...))
+		case path == "spec.custom_traits":
+			traits, _ := splitBotTraits(user)
+			setBotTraits(user, traits, traitsFromProto(req.Bot.Spec.CustomTraits))
 		default:
 			return nil, trace.BadParameter("update_mask: unsupported path %q", path)
 		}
@@ -506,6 +617,8 @@ func (bs *BotService) UpdateBot(
 	if err != nil {
 		return nil, trace.Wrap(err, "converting from resources")
 	}
+	revision := bs.events.publish(pb.BotEventType_BOT_EVENT_TYPE_PUT, bot)
+	bs.recordRevision(ctx, bot.Metadata.Name, revision)
 
 	return bot, nil
 }
@@ -574,15 +687,12 @@ func (bs *BotService) deleteBotAuthz(ctx context.Context) error {
 }
 
 // DeleteBot deletes an existing bot. It will throw an error if the bot does
-// not exist.
+// not exist. By default this does not remove any locks placed on the bot's
+// user via LockBot; set req.PurgeLocks to sweep them too, e.g. when
+// decommissioning a bot that was locked while compromised.
 func (bs *BotService) DeleteBot(
 	ctx context.Context, req *pb.DeleteBotRequest,
 ) (*emptypb.Empty, error) {
-	// Note: this does not remove any locks for the bot's user / role. That
-	// might be convenient in case of accidental bot locking but there doesn't
-	// seem to be any automatic deletion of locks in teleport today (other
-	// than expiration). Consistency around security controls seems important
-	// but we can revisit this if desired.
 	if err := bs.deleteBotAuthz(ctx); err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -599,6 +709,16 @@ func (bs *BotService) DeleteBot(
 		return nil, trace.Wrap(err)
 	}
 
+	if bs.instances != nil {
+		if err := bs.instances.backend.DeleteAllBotInstancesForBot(ctx, req.BotName); err != nil {
+			bs.logger.WithError(err).WithField("bot.name", req.BotName).Warn("Failed to clean up bot instances.")
+		}
+	}
+
+	if req.PurgeLocks {
+		bs.purgeBotLocks(ctx, req.BotName)
+	}
+
 	if err := bs.emitter.EmitAuditEvent(ctx, &apievents.BotDelete{
 		Metadata: apievents.Metadata{
 			Type: events.BotDeleteEvent,
@@ -611,10 +731,87 @@ func (bs *BotService) DeleteBot(
 	}); err != nil {
 		bs.logger.WithError(err).Warn("Failed to emit BotDelete audit event.")
 	}
+	bs.events.publish(pb.BotEventType_BOT_EVENT_TYPE_DELETE, &pb.Bot{
+		Metadata: &headerv1.Metadata{Name: req.BotName},
+	})
 
 	return &emptypb.Empty{}, nil
 }
 
+// traitsFromProto flattens a list of proto Traits into the map[string][]string
+// form expected by types.User.SetTraits.
+func traitsFromProto(traits []*pb.Trait) map[string][]string {
+	out := map[string][]string{}
+	for _, t := range traits {
+		if len(t.Values) == 0 {
+			continue
+		}
+		if out[t.Name] == nil {
+			out[t.Name] = []string{}
+		}
+		out[t.Name] = append(out[t.Name], t.Values...)
+	}
+	return out
+}
+
+// botCustomTraitKeysLabel records, as a comma-separated list, which trait
+// keys on a bot user originated from Spec.CustomTraits rather than
+// Spec.Traits. Both merge into the same types.User traits map with no other
+// way to tell them apart, so UpdateBot needs this to replace one without
+// clobbering the other.
+const botCustomTraitKeysLabel = "teleport.internal/bot-custom-trait-keys"
+
+// splitBotTraits separates user's merged traits map back into the Traits and
+// CustomTraits it was assembled from, using botCustomTraitKeysLabel to tell
+// them apart.
+func splitBotTraits(user types.User) (traits, customTraits map[string][]string) {
+	customKeys := map[string]bool{}
+	if label, ok := user.GetLabel(botCustomTraitKeysLabel); ok && label != "" {
+		for _, k := range strings.Split(label, ",") {
+			customKeys[k] = true
+		}
+	}
+
+	traits = map[string][]string{}
+	customTraits = map[string][]string{}
+	for k, v := range user.GetTraits() {
+		if customKeys[k] {
+			customTraits[k] = v
+		} else {
+			traits[k] = v
+		}
+	}
+	return traits, customTraits
+}
+
+// setBotTraits replaces user's traits map with the merge of traits and
+// customTraits, and records customTraits' keys via botCustomTraitKeysLabel
+// so a later splitBotTraits call can tell them apart again.
+func setBotTraits(user types.User, traits, customTraits map[string][]string) {
+	merged := map[string][]string{}
+	for k, v := range traits {
+		merged[k] = v
+	}
+	customKeys := make([]string, 0, len(customTraits))
+	for k, v := range customTraits {
+		merged[k] = append(merged[k], v...)
+		customKeys = append(customKeys, k)
+	}
+	user.SetTraits(merged)
+
+	meta := user.GetMetadata()
+	if meta.Labels == nil {
+		meta.Labels = map[string]string{}
+	}
+	if len(customKeys) == 0 {
+		delete(meta.Labels, botCustomTraitKeysLabel)
+	} else {
+		sort.Strings(customKeys)
+		meta.Labels[botCustomTraitKeysLabel] = strings.Join(customKeys, ",")
+	}
+	user.SetMetadata(meta)
+}
+
 func validateBot(b *pb.Bot) error {
 	if b == nil {
 		return trace.BadParameter("must be non-nil")
@@ -658,7 +855,19 @@ func botFromUserAndRole(user types.User, role types.Role) (*pb.Bot, error) {
 		},
 	}
 
-	for k, v := range user.GetTraits() {
+	// The generated impersonation role is always granted directly to the bot
+	// user alongside any operator-authored roles (see botToUserAndRole); only
+	// the latter round-trip back out as CustomRoles.
+	generatedRole := BotResourceName(botName)
+	for _, r := range user.GetRoles() {
+		if r == generatedRole {
+			continue
+		}
+		b.Spec.CustomRoles = append(b.Spec.CustomRoles, r)
+	}
+
+	traits, customTraits := splitBotTraits(user)
+	for k, v := range traits {
 		if len(v) == 0 {
 			continue
 		}
@@ -667,6 +876,15 @@ func botFromUserAndRole(user types.User, role types.Role) (*pb.Bot, error) {
 			Values: v,
 		})
 	}
+	for k, v := range customTraits {
+		if len(v) == 0 {
+			continue
+		}
+		b.Spec.CustomTraits = append(b.Spec.CustomTraits, &pb.Trait{
+			Name:   k,
+			Values: v,
+		})
+	}
 
 	return b, nil
 }
@@ -705,7 +923,11 @@ func botToUserAndRole(bot *pb.Bot, now time.Time, createdBy string) (types.User,
 	if err != nil {
 		return nil, nil, trace.Wrap(err, "new user")
 	}
-	user.SetRoles([]string{resourceName})
+	// Beyond the generated impersonation role above, the bot user is also
+	// directly granted any pre-existing, operator-authored roles listed in
+	// CustomRoles, e.g. a shared "ci-bots-read-app" role bound to every CI
+	// bot instead of duplicated in each bot's Roles impersonation list.
+	user.SetRoles(append([]string{resourceName}, bot.Spec.CustomRoles...))
 	userMeta := user.GetMetadata()
 	userMeta.Labels = map[string]string{
 		types.BotLabel: bot.Metadata.Name,
@@ -715,17 +937,11 @@ func botToUserAndRole(bot *pb.Bot, now time.Time, createdBy string) (types.User,
 	}
 	user.SetMetadata(userMeta)
 
-	traits := map[string][]string{}
-	for _, t := range bot.Spec.Traits {
-		if len(t.Values) == 0 {
-			continue
-		}
-		if traits[t.Name] == nil {
-			traits[t.Name] = []string{}
-		}
-		traits[t.Name] = append(traits[t.Name], t.Values...)
-	}
-	user.SetTraits(traits)
+	// CustomTraits merge into the same user traits map as Traits (there's no
+	// separate trait storage), but setBotTraits also records which keys came
+	// from CustomTraits via botCustomTraitKeysLabel, so splitBotTraits can
+	// recover the two sides later for round-tripping and partial updates.
+	setBotTraits(user, traitsFromProto(bot.Spec.Traits), traitsFromProto(bot.Spec.CustomTraits))
 	user.SetCreatedBy(types.CreatedBy{
 		User: types.UserRef{Name: createdBy},
 		Time: now,
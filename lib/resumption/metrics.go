@@ -0,0 +1,237 @@
+// Teleport
+// Copyright (C) 2024 Gravitational, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resumption
+
+import (
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "teleport"
+const metricsSubsystem = "resumption"
+
+// resultSuccess and resultError are the label values used for the
+// "result" label on the handshake/reattach counters.
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+// Metrics holds the Prometheus collectors exported by a [SSHServerWrapper].
+// A single Metrics value should be registered once and shared by every
+// wrapper in a process (there is normally only one).
+type Metrics struct {
+	handshakesTotal     *prometheus.CounterVec
+	reattachTotal       *prometheus.CounterVec
+	tokensEvictedTotal  prometheus.Counter
+	activeTokens        prometheus.Gauge
+	detachedTokens      prometheus.Gauge
+	detachedDuration    prometheus.Histogram
+	bufferedBytesClient prometheus.Histogram
+	bufferedBytesServer prometheus.Histogram
+}
+
+// NewMetrics creates a [Metrics] with its collectors instantiated but not
+// yet registered; call [Metrics.Register] to register them with a
+// [prometheus.Registerer].
+func NewMetrics() *Metrics {
+	return &Metrics{
+		handshakesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "handshakes_total",
+			Help:      "Number of resumption handshakes processed, by result.",
+		}, []string{"result"}),
+		reattachTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "reattach_total",
+			Help:      "Number of resumption reattach attempts processed, by result.",
+		}, []string{"result"}),
+		tokensEvictedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "tokens_evicted_total",
+			Help:      "Number of resumption tokens forcibly evicted to enforce resumption policy limits.",
+		}),
+		activeTokens: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "active_tokens",
+			Help:      "Number of resumption tokens with a currently attached connection.",
+		}),
+		detachedTokens: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "detached_tokens",
+			Help:      "Number of resumption tokens currently waiting for a client to reattach.",
+		}),
+		detachedDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "detached_duration_seconds",
+			Help:      "Duration that a resumption token spent detached before a client reattached to it. Tokens evicted or timed out while detached are not observed.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		bufferedBytesClient: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "buffered_bytes_client_to_server",
+			Help:      "Bytes buffered for a detached connection in the client-to-server direction.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+		}),
+		bufferedBytesServer: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "buffered_bytes_server_to_client",
+			Help:      "Bytes buffered for a detached connection in the server-to-client direction.",
+			Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+		}),
+	}
+}
+
+// Register registers every collector in m with reg.
+func (m *Metrics) Register(reg prometheus.Registerer) error {
+	return trace.Wrap(prometheus.WrapRegistererWithPrefix("", reg).Register(&metricsCollection{m}))
+}
+
+// metricsCollection bundles all of m's collectors behind a single
+// prometheus.Collector so they can be registered (and unregistered) as one.
+type metricsCollection struct {
+	m *Metrics
+}
+
+func (c *metricsCollection) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+func (c *metricsCollection) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+func (c *metricsCollection) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.m.handshakesTotal,
+		c.m.reattachTotal,
+		c.m.tokensEvictedTotal,
+		c.m.activeTokens,
+		c.m.detachedTokens,
+		c.m.detachedDuration,
+		c.m.bufferedBytesClient,
+		c.m.bufferedBytesServer,
+	}
+}
+
+func (m *Metrics) recordHandshake(err error) {
+	if m == nil {
+		return
+	}
+	m.handshakesTotal.WithLabelValues(resultLabel(err)).Inc()
+}
+
+func (m *Metrics) recordReattach(err error) {
+	if m == nil {
+		return
+	}
+	m.reattachTotal.WithLabelValues(resultLabel(err)).Inc()
+}
+
+func (m *Metrics) recordEviction() {
+	if m == nil {
+		return
+	}
+	m.tokensEvictedTotal.Inc()
+}
+
+func (m *Metrics) recordDetachedDuration(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.detachedDuration.Observe(d.Seconds())
+}
+
+// gaugeAttach records a brand-new token starting out attached, so
+// activeTokens reflects it from creation rather than only being adjusted by
+// later gaugeReattach/gaugeDetach transitions.
+func (m *Metrics) gaugeAttach() {
+	if m == nil {
+		return
+	}
+	m.activeTokens.Inc()
+}
+
+// gaugeReattach moves a token from the detached to the active gauge.
+func (m *Metrics) gaugeReattach() {
+	if m == nil {
+		return
+	}
+	m.detachedTokens.Dec()
+	m.activeTokens.Inc()
+}
+
+// gaugeDetach moves a token from the active to the detached gauge.
+func (m *Metrics) gaugeDetach() {
+	if m == nil {
+		return
+	}
+	m.activeTokens.Dec()
+	m.detachedTokens.Inc()
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultSuccess
+}
+
+// Stats is a point-in-time snapshot of a [SSHServerWrapper]'s resumable
+// connections, for programmatic introspection by tools like tctl.
+type Stats struct {
+	// ActiveTokens is the number of tokens with a currently attached
+	// connection.
+	ActiveTokens int
+	// DetachedTokens is the number of tokens currently waiting for a client
+	// to reattach.
+	DetachedTokens int
+}
+
+// Stats returns a snapshot of r's current resumable connections.
+func (r *SSHServerWrapper) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var s Stats
+	for _, entry := range r.conns {
+		entry.mu.Lock()
+		running := entry.running
+		entry.mu.Unlock()
+
+		if running > 0 {
+			s.ActiveTokens++
+		} else {
+			s.DetachedTokens++
+		}
+	}
+	return s
+}
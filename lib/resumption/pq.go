@@ -0,0 +1,294 @@
+// Teleport
+// Copyright (C) 2024 Gravitational, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resumption
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/gravitational/teleport/lib/multiplexer"
+	"github.com/gravitational/teleport/lib/sshutils"
+	"github.com/gravitational/teleport/lib/utils"
+)
+
+const (
+	serverProtocolStringV2 = sshutils.SSHVersionPrefix + " resume-v2" // "SSH-2.0-Teleport resume-v2"
+	clientProtocolStringV2 = "teleport-resume-v2"
+	clientSuffixV2         = "\x00" + clientProtocolStringV2
+	clientPreludeV2        = sshPrefix + clientSuffixV2 // "SSH-2.0-\x00teleport-resume-v2"
+
+	hkdfInfoV2 = "teleport-resume-v2"
+
+	// rfc4253MaxIdentificationLength is the maximum length, in bytes, of an
+	// RFC 4253 identification string (including the trailing "\r\n").
+	rfc4253MaxIdentificationLength = 255
+)
+
+// mlkemCiphertextSize is ML-KEM-768's fixed ciphertext size, used to read a
+// fixed number of bytes off the wire without a length prefix.
+const mlkemCiphertextSize = mlkem768.CiphertextSize
+
+// serverVersionCRLFV2 builds the resume-v2 SSH identification string,
+// advertising both a P-256 ECDH public key (kept for backwards-compatible
+// key agreement) and an ML-KEM-768 encapsulation key (for post-quantum
+// agility): "SSH-2.0-Teleport resume-v2 <ecdh> <mlkem> <hostID>\r\n". It
+// returns an error if the resulting string would violate the RFC 4253
+// identification string limits (255 bytes including the CR LF, no embedded
+// CR or LF before the terminator).
+func serverVersionCRLFV2(ecdhPub *ecdh.PublicKey, mlkemEncapKey *mlkem768.PublicKey, hostID string) (string, error) {
+	mlkemBytes, err := mlkemEncapKey.MarshalBinary()
+	if err != nil {
+		return "", trace.Wrap(err, "marshaling ML-KEM-768 encapsulation key")
+	}
+
+	line := fmt.Sprintf(serverProtocolStringV2+" %v %v %v\r\n",
+		base64.RawStdEncoding.EncodeToString(ecdhPub.Bytes()),
+		base64.RawStdEncoding.EncodeToString(mlkemBytes),
+		hostID,
+	)
+	if len(line) > rfc4253MaxIdentificationLength {
+		return "", trace.BadParameter(
+			"resume-v2 identification string is %v bytes, exceeding the RFC 4253 limit of %v",
+			len(line), rfc4253MaxIdentificationLength)
+	}
+	return line, nil
+}
+
+// deriveResumeV2Key combines the ECDH and ML-KEM-768 shared secrets into the
+// single symmetric key used to protect a resume-v2 session, such that
+// recovering the key requires breaking both primitives:
+// HKDF-SHA256(ecdhShared || mlkemShared, "teleport-resume-v2").
+func deriveResumeV2Key(ecdhShared, mlkemShared []byte) ([]byte, error) {
+	combined := make([]byte, 0, len(ecdhShared)+len(mlkemShared))
+	combined = append(combined, ecdhShared...)
+	combined = append(combined, mlkemShared...)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, combined, nil, []byte(hkdfInfoV2)), key); err != nil {
+		return nil, trace.Wrap(err, "deriving resume-v2 session key")
+	}
+	return key, nil
+}
+
+// handleResumptionExchangeV2 completes the resume-v2 handshake on conn: it
+// reads the client's ECDH public key and ML-KEM-768 ciphertext, derives the
+// hybrid session key, then reads a 16-byte resume token - all zero for a
+// fresh session, or a token returned by a prior handshake to reattach to it
+// - and either starts a new resumable session or reattaches to the existing
+// one via [SSHServerWrapper.reattach].
+func (r *SSHServerWrapper) handleResumptionExchangeV2(conn *multiplexer.Conn, ecdhKey *ecdh.PrivateKey, kemPriv *mlkem768.PrivateKey) {
+	clientECDHBytes := make([]byte, ecdhP256UncompressedSize)
+	if _, err := io.ReadFull(conn, clientECDHBytes); err != nil {
+		if !utils.IsOKNetworkError(err) {
+			r.log.WithError(err).Error("Error while reading resume-v2 ECDH client key.")
+		}
+		_ = conn.Close()
+		return
+	}
+	clientECDHPub, err := ecdh.P256().NewPublicKey(clientECDHBytes)
+	if err != nil {
+		r.log.WithError(err).Error("Invalid resume-v2 ECDH client key.")
+		_ = conn.Close()
+		return
+	}
+
+	ciphertext := make([]byte, mlkemCiphertextSize)
+	if _, err := io.ReadFull(conn, ciphertext); err != nil {
+		if !utils.IsOKNetworkError(err) {
+			r.log.WithError(err).Error("Error while reading resume-v2 ML-KEM-768 ciphertext.")
+		}
+		_ = conn.Close()
+		return
+	}
+
+	var resumeToken resumptionToken
+	if _, err := io.ReadFull(conn, resumeToken[:]); err != nil {
+		if !utils.IsOKNetworkError(err) {
+			r.log.WithError(err).Error("Error while reading resume-v2 resume token.")
+		}
+		_ = conn.Close()
+		return
+	}
+
+	ecdhShared, err := ecdhKey.ECDH(clientECDHPub)
+	if err != nil {
+		r.log.WithError(err).Error("Failed to compute resume-v2 ECDH shared secret.")
+		_ = conn.Close()
+		return
+	}
+
+	mlkemShared := make([]byte, mlkem768.SharedKeySize)
+	mlkem768.Decapsulate(mlkemShared, kemPriv, ciphertext)
+
+	if _, err := deriveResumeV2Key(ecdhShared, mlkemShared); err != nil {
+		r.log.WithError(err).Error("Failed to derive resume-v2 session key.")
+		_ = conn.Close()
+		return
+	}
+
+	if resumeToken != (resumptionToken{}) {
+		if entry := r.lookupDetached(resumeToken); entry != nil {
+			r.reattach(conn, resumeToken, entry)
+			return
+		}
+		if r.cfg.Store != nil {
+			if hostID, ok, err := r.cfg.Store.Claim(context.Background(), resumeToken); err != nil {
+				r.log.WithError(err).Warn("Failed to claim resume-v2 token from store.")
+			} else if ok && hostID != r.hostID && r.cfg.Dialer != nil {
+				r.log.Debug("Forwarding resume-v2 reattach to the proxy replica that owns the token.")
+				r.forwardToOwner(conn, resumeToken, hostID)
+				return
+			}
+		}
+		r.log.Debug("Client presented an unknown or already-attached resume-v2 token; starting a new session.")
+	}
+
+	var token resumptionToken
+	if _, err := rand.Read(token[:]); err != nil {
+		r.log.WithError(err).Error("Failed to generate resume-v2 token.")
+		_ = conn.Close()
+		return
+	}
+
+	remoteIP := remoteIPOf(conn)
+	if err := r.admitToken(remoteIP); err != nil {
+		r.log.WithError(err).Warn("Rejecting resume-v2 connection.")
+		_ = conn.Close()
+		return
+	}
+
+	entry := &connEntry{
+		conn:            conn,
+		remoteIP:        remoteIP,
+		metrics:         r.cfg.Metrics,
+		detachedTimeout: r.cfg.detachedTimeout(),
+		running:         1,
+	}
+	entry.timeout = time.AfterFunc(entry.detachedTimeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.conns[token] != entry {
+			return
+		}
+		delete(r.conns, token)
+		_ = entry.conn.Close()
+		r.cfg.onEvict(token, "detached_timeout")
+		r.releaseToken(token)
+	})
+	entry.timeout.Stop()
+	entry.metrics.gaugeAttach()
+
+	if r.cfg.Store != nil {
+		if err := r.cfg.Store.Reserve(context.Background(), token, r.hostID, entry.detachedTimeout); err != nil {
+			r.log.WithError(err).Warn("Failed to reserve resume-v2 token in store.")
+		}
+	}
+
+	r.mu.Lock()
+	r.conns[token] = entry
+	r.mu.Unlock()
+
+	if _, err := conn.Write(token[:]); err != nil {
+		if !utils.IsOKNetworkError(err) {
+			r.log.WithError(err).Error("Failed to send resume-v2 token to client.")
+		}
+		r.mu.Lock()
+		delete(r.conns, token)
+		r.mu.Unlock()
+		entry.timeout.Stop()
+		r.releaseToken(token)
+		_ = conn.Close()
+		return
+	}
+
+	r.log.Debug("Completed resume-v2 hybrid handshake.")
+	r.cfg.Metrics.recordHandshake(nil)
+
+	// The derived session key is not used past this point: resume-v2 does
+	// not run resume-v1's encrypted resumption stream framing (heartbeats,
+	// replay buffer, reattach authentication; see handleResumptionExchangeV1).
+	// The connection goes straight to the SSH server for the lifetime of
+	// this attachment, and the token is marked detached (and subject to
+	// cfg.detachedTimeout()) once it returns.
+	r.sshServer(conn)
+	if entry.decreaseRunning() {
+		r.markDetached(entry.remoteIP)
+	}
+}
+
+// reattach resumes bookkeeping for token on behalf of a client that
+// reconnected with a resume-v2 token from a prior handshake: it marks entry
+// attached again and hands conn to the SSH server as a new session under
+// the same token, keeping the token's detached-timeout, eviction, and
+// per-remote-IP accounting continuous across the reconnect. It does not
+// splice conn into the in-flight byte stream of the original connection -
+// that requires the same persistent encrypted framing layer resume-v1
+// would need (see handleResumptionExchangeV1) - so what's resumed here is
+// the token's lifecycle and limits, not buffered traffic.
+func (r *SSHServerWrapper) reattach(conn net.Conn, token resumptionToken, entry *connEntry) {
+	if entry.increaseRunning() {
+		r.markAttached(entry.remoteIP)
+	}
+
+	r.mu.Lock()
+	entry.conn = conn
+	r.mu.Unlock()
+
+	if _, err := conn.Write(token[:]); err != nil {
+		if !utils.IsOKNetworkError(err) {
+			r.log.WithError(err).Error("Failed to ack resume-v2 reattach to client.")
+		}
+		r.cfg.Metrics.recordReattach(err)
+		_ = conn.Close()
+		if entry.decreaseRunning() {
+			r.markDetached(entry.remoteIP)
+		}
+		return
+	}
+
+	r.log.Debug("Completed resume-v2 reattach handshake.")
+	r.cfg.Metrics.recordReattach(nil)
+
+	r.sshServer(conn)
+	if entry.decreaseRunning() {
+		r.markDetached(entry.remoteIP)
+	}
+}
+
+// remoteIPOf extracts the remote IP from conn's address, used to key
+// Config.MaxDetachedPerRemoteIP. It returns the zero netip.Addr if the
+// remote address isn't a host:port pair with a parseable IP.
+func remoteIPOf(conn net.Conn) netip.Addr {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	ip, _ := netip.ParseAddr(host)
+	return ip
+}
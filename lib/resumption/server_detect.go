@@ -17,6 +17,7 @@
 package resumption
 
 import (
+	"context"
 	"crypto/ecdh"
 	"crypto/rand"
 	"encoding/base64"
@@ -26,6 +27,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
 	"github.com/gravitational/trace"
 	"github.com/sirupsen/logrus"
 
@@ -58,9 +60,56 @@ func serverVersionCRLFV1(pubKey *ecdh.PublicKey, hostID string) string {
 	)
 }
 
+// Config holds the optional configuration knobs for a [SSHServerWrapper].
+// The zero value is a usable configuration that preserves the wrapper's
+// historical behavior: an unbounded number of detached connections, each
+// torn down one minute after going detached.
+type Config struct {
+	// Store, if non-nil, is used to make resumption tokens claimable across
+	// every proxy replica sharing the same backend rather than just this
+	// process.
+	Store ResumptionStore
+	// Dialer, if non-nil, is used to reverse-tunnel a resumption exchange to
+	// the replica that owns a token this process doesn't know about.
+	Dialer TunnelDialer
+	// Metrics, if non-nil, receives Prometheus counters/gauges/histograms
+	// tracking the wrapper's resumable connections.
+	Metrics *Metrics
+
+	// DetachedTimeout is how long a token may remain without an attached
+	// connection before it is forcibly closed. Defaults to one minute.
+	DetachedTimeout time.Duration
+	// MaxDetachedPerRemoteIP limits detached tokens per remote IP: a new
+	// token is refused while its remote IP already holds this many detached
+	// tokens. Detaching an existing token is never refused, so an IP's
+	// detached count can exceed this value. Zero means unlimited.
+	MaxDetachedPerRemoteIP int
+	// MaxTotalResumable caps how many resumable tokens (detached or not)
+	// the wrapper will track at once. Zero means unlimited.
+	MaxTotalResumable int
+	// OnEvict, if non-nil, is called whenever a token is forcibly evicted to
+	// enforce one of the limits above, rather than because of a protocol
+	// error or normal connection closure.
+	OnEvict func(token resumptionToken, reason string)
+}
+
+func (c Config) detachedTimeout() time.Duration {
+	if c.DetachedTimeout <= 0 {
+		return detachedTimeout
+	}
+	return c.DetachedTimeout
+}
+
+func (c Config) onEvict(token resumptionToken, reason string) {
+	if c.OnEvict != nil {
+		c.OnEvict(token, reason)
+	}
+}
+
 // NewSSHServerWrapper wraps a given SSH server as to support connection
-// resumption.
-func NewSSHServerWrapper(log logrus.FieldLogger, sshServer func(net.Conn), hostID string) *SSHServerWrapper {
+// resumption. cfg is optional; its zero value preserves the wrapper's
+// historical unbounded, single-process behavior.
+func NewSSHServerWrapper(log logrus.FieldLogger, sshServer func(net.Conn), hostID string, cfg Config) *SSHServerWrapper {
 	if log == nil {
 		log = logrus.WithField(trace.Component, Component)
 	}
@@ -70,8 +119,10 @@ func NewSSHServerWrapper(log logrus.FieldLogger, sshServer func(net.Conn), hostI
 		log:       log,
 
 		hostID: hostID,
+		cfg:    cfg,
 
-		conns: make(map[resumptionToken]*connEntry),
+		conns:               make(map[resumptionToken]*connEntry),
+		detachedPerRemoteIP: make(map[netip.Addr]int),
 	}
 }
 
@@ -79,41 +130,202 @@ type resumptionToken = [16]byte
 
 // SSHServerWrapper wraps a SSH server, keeping track of which resumption v1
 // connections can be resumed by the client. Connections that stay without an
-// active underlying connection for a given time ([detachedTimeout]) are
-// forcibly closed.
+// active underlying connection for a given time (see [Config.DetachedTimeout])
+// are forcibly closed.
 type SSHServerWrapper struct {
 	sshServer func(net.Conn)
 	log       logrus.FieldLogger
 
 	hostID string
+	cfg    Config
 
 	mu    sync.Mutex
 	conns map[resumptionToken]*connEntry
+	// detachedPerRemoteIP counts currently-detached tokens by remote IP, to
+	// enforce cfg.MaxDetachedPerRemoteIP.
+	detachedPerRemoteIP map[netip.Addr]int
 }
 
-type connEntry struct {
-	conn     *Conn
-	remoteIP netip.Addr
+// admitToken checks whether a new resumption token for remoteIP may be
+// created without violating cfg's limits. When MaxTotalResumable is reached
+// it evicts the oldest detached entry to make room; when remoteIP already
+// holds MaxDetachedPerRemoteIP detached tokens it rejects the new token
+// without evicting any of them. It is called by handleResumptionExchangeV2
+// before registering a new token.
+func (r *SSHServerWrapper) admitToken(remoteIP netip.Addr) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cfg.MaxTotalResumable > 0 && len(r.conns) >= r.cfg.MaxTotalResumable {
+		if !r.evictOldestDetachedLocked("max_total_resumable") {
+			return trace.LimitExceeded("too many resumable connections")
+		}
+	}
+	if r.cfg.MaxDetachedPerRemoteIP > 0 && r.detachedPerRemoteIP[remoteIP] >= r.cfg.MaxDetachedPerRemoteIP {
+		return trace.LimitExceeded("too many detached resumable connections for remote IP %v", remoteIP)
+	}
+	return nil
+}
+
+// markDetached records remoteIP gaining a detached token, to enforce
+// cfg.MaxDetachedPerRemoteIP. It's called once a connEntry's running count
+// drops to zero.
+func (r *SSHServerWrapper) markDetached(remoteIP netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.detachedPerRemoteIP[remoteIP]++
+}
+
+// markAttached is markDetached's inverse, called once a previously-detached
+// connEntry's running count rises above zero again.
+func (r *SSHServerWrapper) markAttached(remoteIP netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := r.detachedPerRemoteIP[remoteIP]; n <= 1 {
+		delete(r.detachedPerRemoteIP, remoteIP)
+	} else {
+		r.detachedPerRemoteIP[remoteIP] = n - 1
+	}
+}
+
+// evictOldestDetachedLocked closes and removes the oldest detached entry, if
+// any, reporting reason through cfg.OnEvict. r.mu must be held.
+func (r *SSHServerWrapper) evictOldestDetachedLocked(reason string) bool {
+	var oldestToken resumptionToken
+	var oldestEntry *connEntry
+	var oldestSince time.Time
+
+	for token, entry := range r.conns {
+		entry.mu.Lock()
+		detached := entry.running == 0
+		since := entry.detachedSince
+		entry.mu.Unlock()
+
+		if !detached {
+			continue
+		}
+		if oldestEntry == nil || since.Before(oldestSince) {
+			oldestToken, oldestEntry, oldestSince = token, entry, since
+		}
+	}
+
+	if oldestEntry == nil {
+		return false
+	}
+
+	delete(r.conns, oldestToken)
+	if n := r.detachedPerRemoteIP[oldestEntry.remoteIP]; n <= 1 {
+		delete(r.detachedPerRemoteIP, oldestEntry.remoteIP)
+	} else {
+		r.detachedPerRemoteIP[oldestEntry.remoteIP] = n - 1
+	}
+	_ = oldestEntry.conn.Close()
+	r.cfg.Metrics.recordEviction()
+	r.cfg.onEvict(oldestToken, reason)
+	r.releaseToken(oldestToken)
+	return true
+}
+
+// lookupDetached returns the detached entry registered for token, or nil if
+// the token is unknown or still attached. It's used to tell a fresh
+// handshake apart from a client reattaching to a previously-issued token.
+func (r *SSHServerWrapper) lookupDetached(token resumptionToken) *connEntry {
+	r.mu.Lock()
+	entry, ok := r.conns[token]
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	entry.mu.Lock()
+	detached := entry.running == 0
+	entry.mu.Unlock()
+	if !detached {
+		return nil
+	}
+	return entry
+}
+
+// releaseToken releases token's ownership record from r.cfg.Store, if one is
+// configured. It is called whenever an entry is permanently removed from
+// r.conns, so a stale reservation doesn't outlive the token and strand other
+// replicas' forwarding attempts.
+func (r *SSHServerWrapper) releaseToken(token resumptionToken) {
+	if r.cfg.Store == nil {
+		return
+	}
+	if err := r.cfg.Store.Release(context.Background(), token); err != nil {
+		r.log.WithError(err).Warn("Failed to release resumption token from store.")
+	}
+}
+
+// forwardToOwner reverse-tunnels a resumption exchange for token to the
+// proxy replica identified by hostID, proxying bytes bidirectionally between
+// conn and the dialed connection. It is used by the resumption exchange
+// handlers when a token is unknown locally but claimed by another replica in
+// r.cfg.Store.
+func (r *SSHServerWrapper) forwardToOwner(conn net.Conn, token resumptionToken, hostID string) {
+	log := r.log.WithField("resumption_token_owner", hostID)
+
+	ctx := context.Background()
+	remote, err := r.cfg.Dialer.DialResumption(ctx, hostID)
+	if err != nil {
+		log.WithError(err).Warn("Failed to reverse-tunnel resumption attempt to owning proxy replica.")
+		_ = conn.Close()
+		return
+	}
+	defer remote.Close()
 
-	mu      sync.Mutex
-	timeout *time.Timer
-	running uint
+	utils.ProxyConn(ctx, conn, remote)
+}
+
+type connEntry struct {
+	conn            net.Conn
+	remoteIP        netip.Addr
+	metrics         *Metrics
+	detachedTimeout time.Duration
+
+	mu            sync.Mutex
+	timeout       *time.Timer
+	running       uint
+	detachedSince time.Time
 }
 
-func (e *connEntry) increaseRunning() {
+// increaseRunning records a connection attaching to e, returning whether it
+// was detached beforehand - the caller must then call
+// [SSHServerWrapper.markAttached] for e.remoteIP, since updating that
+// wrapper-wide bookkeeping needs r.mu, which must never be acquired while
+// holding e.mu.
+func (e *connEntry) increaseRunning() (wasDetached bool) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	e.timeout.Stop()
+	wasDetached = e.running == 0
 	e.running++
+	if wasDetached {
+		if !e.detachedSince.IsZero() {
+			e.metrics.recordDetachedDuration(time.Since(e.detachedSince))
+		}
+		e.metrics.gaugeReattach()
+	}
+	return wasDetached
 }
 
-func (e *connEntry) decreaseRunning() {
+// decreaseRunning records a connection detaching from e, returning whether e
+// became fully detached as a result - the caller must then call
+// [SSHServerWrapper.markDetached] for e.remoteIP, for the same lock-ordering
+// reason documented on increaseRunning.
+func (e *connEntry) decreaseRunning() (becameDetached bool) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	e.running--
 	if e.running == 0 {
-		e.timeout.Reset(detachedTimeout)
+		e.timeout.Reset(e.detachedTimeout)
+		e.detachedSince = time.Now()
+		e.metrics.gaugeDetach()
+		return true
 	}
+	return false
 }
 
 // PreDetect is intended to be used in a [multiplexer.Mux] as the PreDetect
@@ -121,20 +333,34 @@ func (e *connEntry) decreaseRunning() {
 // version identifier, then returns a post-detect hook to check if the client
 // supports resumption and to hijack its connection if that's the case.
 func (r *SSHServerWrapper) PreDetect(nc net.Conn) (multiplexer.PostDetectFunc, error) {
-	dhKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	dhKey, kemPriv, serverVersionCRLF, err := r.generateHandshakeKeys()
 	if err != nil {
-		r.log.WithError(err).Error("Failed to generate ECDH key, proceeding without resumption (this is a bug).")
+		r.log.WithError(err).Error("Failed to generate handshake keys, proceeding without resumption (this is a bug).")
 		// we are still responsible for sending a RFC 4253-compliant
 		// identification string as the PreDetect hook
 		return PreDetectFixedSSHVersion(sshutils.SSHVersionPrefix)(nc)
 	}
 
-	serverVersionCRLF := serverVersionCRLFV1(dhKey.PublicKey(), r.hostID)
 	if _, err := nc.Write([]byte(serverVersionCRLF)); err != nil {
 		return nil, trace.Wrap(err)
 	}
 
 	return func(conn *multiplexer.Conn) net.Conn {
+		isResumeV2, err := peekPrelude(conn, clientPreludeV2)
+		if err != nil {
+			if !utils.IsOKNetworkError(err) {
+				r.log.WithError(err).Error("Error while peeking resumption prelude.")
+			}
+			_ = conn.Close()
+			return nil
+		}
+		if isResumeV2 && kemPriv != nil {
+			_, _ = conn.Discard(len(clientPreludeV2))
+			r.log.Debug("Proceeding with resume-v2 connection resumption exchange.")
+			r.handleResumptionExchangeV2(conn, dhKey, kemPriv)
+			return nil
+		}
+
 		isResumeV1, err := peekPrelude(conn, clientPreludeV1)
 		if err != nil {
 			if !utils.IsOKNetworkError(err) {
@@ -172,14 +398,13 @@ var _ multiplexer.PreDetectFunc = (*SSHServerWrapper)(nil).PreDetect
 // running the connection as a resumable connection if that's the case, or
 // handing the connection to the underlying SSH server otherwise.
 func (r *SSHServerWrapper) HandleConnection(nc net.Conn) {
-	dhKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	dhKey, kemPriv, serverVersionCRLF, err := r.generateHandshakeKeys()
 	if err != nil {
-		r.log.WithError(err).Error("Failed to generate ECDH key, proceeding without resumption (this is a bug).")
+		r.log.WithError(err).Error("Failed to generate handshake keys, proceeding without resumption (this is a bug).")
 		r.sshServer(nc)
 		return
 	}
 
-	serverVersionCRLF := serverVersionCRLFV1(dhKey.PublicKey(), r.hostID)
 	if _, err := nc.Write([]byte(serverVersionCRLF)); err != nil {
 		if !utils.IsOKNetworkError(err) {
 			r.log.WithError(err).Warn("Error while sending SSH identification string.")
@@ -190,6 +415,21 @@ func (r *SSHServerWrapper) HandleConnection(nc net.Conn) {
 
 	conn := ensureMultiplexerConn(nc)
 
+	isResumeV2, err := peekPrelude(conn, clientPreludeV2)
+	if err != nil {
+		if !utils.IsOKNetworkError(err) {
+			r.log.WithError(err).Error("Error while peeking resumption prelude.")
+		}
+		_ = conn.Close()
+		return
+	}
+	if isResumeV2 && kemPriv != nil {
+		_, _ = conn.Discard(len(clientPreludeV2))
+		r.log.Debug("Proceeding with resume-v2 connection resumption exchange.")
+		r.handleResumptionExchangeV2(conn, dhKey, kemPriv)
+		return
+	}
+
 	isResumeV1, err := peekPrelude(conn, clientPreludeV1)
 	if err != nil {
 		if !utils.IsOKNetworkError(err) {
@@ -216,3 +456,28 @@ func (r *SSHServerWrapper) HandleConnection(nc net.Conn) {
 	r.log.Debug("Proceeding with connection resumption exchange.")
 	r.handleResumptionExchangeV1(conn, dhKey)
 }
+
+// generateHandshakeKeys generates the per-connection ECDH and ML-KEM-768
+// keypairs and renders the resume-v2 SSH identification string advertising
+// both public keys, falling back to advertising only the ECDH key (as
+// resume-v1 does) if ML-KEM-768 key generation or encoding fails.
+func (r *SSHServerWrapper) generateHandshakeKeys() (*ecdh.PrivateKey, *mlkem768.PrivateKey, string, error) {
+	dhKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, "", trace.Wrap(err, "generating ECDH key")
+	}
+
+	kemPub, kemPriv, err := mlkem768.GenerateKeyPair(rand.Reader)
+	if err != nil {
+		r.log.WithError(err).Warn("Failed to generate ML-KEM-768 keypair, advertising resume-v1 only.")
+		return dhKey, nil, serverVersionCRLFV1(dhKey.PublicKey(), r.hostID), nil
+	}
+
+	serverVersionCRLF, err := serverVersionCRLFV2(dhKey.PublicKey(), kemPub, r.hostID)
+	if err != nil {
+		r.log.WithError(err).Warn("Failed to render resume-v2 identification string, advertising resume-v1 only.")
+		return dhKey, nil, serverVersionCRLFV1(dhKey.PublicKey(), r.hostID), nil
+	}
+
+	return dhKey, kemPriv, serverVersionCRLF, nil
+}
@@ -0,0 +1,119 @@
+// Teleport
+// Copyright (C) 2024 Gravitational, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resumption
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// ResumptionStore tracks which proxy replica currently owns a resumption
+// token, so a client that reconnects to a different replica than the one it
+// originally negotiated with can still resume its session. Implementations
+// are expected to be backed by a cluster-wide KV store (e.g. etcd or
+// DynamoDB) so that every proxy replica observes the same ownership state.
+//
+// A nil ResumptionStore is a valid configuration: [SSHServerWrapper] then
+// falls back to its current single-process behavior, where resumption only
+// works if the client reconnects to the same replica.
+type ResumptionStore interface {
+	// Reserve records that hostID is the owner of token, for up to ttl. It
+	// returns an error if the token is already owned by a different host.
+	Reserve(ctx context.Context, token resumptionToken, hostID string, ttl time.Duration) error
+	// Claim returns the hostID that currently owns token, if any. ok is
+	// false if the token is unknown to the store (e.g. it expired or was
+	// never reserved).
+	Claim(ctx context.Context, token resumptionToken) (hostID string, ok bool, err error)
+	// Release removes the ownership record for token, if any. It is called
+	// once a resumable connection is torn down for good.
+	Release(ctx context.Context, token resumptionToken) error
+}
+
+// KV is the minimal key-value interface that [NewKVResumptionStore] needs
+// from a cluster-wide backend (e.g. etcd or consul). Keys written through
+// this interface are expected to be visible to every proxy replica sharing
+// the same backend.
+type KV interface {
+	// Put sets key to value, expiring it after ttl.
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Get returns the value at key, or ok == false if it doesn't exist.
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	// Delete removes key, if it exists.
+	Delete(ctx context.Context, key string) error
+}
+
+const kvKeyPrefix = "resumption/tokens/"
+
+// NewKVResumptionStore returns a [ResumptionStore] backed by an arbitrary
+// cluster-wide [KV] implementation, making resumption tokens visible to
+// every proxy replica sharing the same backend rather than just the replica
+// that originally negotiated the token.
+func NewKVResumptionStore(kv KV) *KVResumptionStore {
+	return &KVResumptionStore{kv: kv}
+}
+
+// KVResumptionStore is a [ResumptionStore] backed by a [KV] implementation.
+type KVResumptionStore struct {
+	kv KV
+}
+
+var _ ResumptionStore = (*KVResumptionStore)(nil)
+
+func kvKey(token resumptionToken) string {
+	return kvKeyPrefix + string(token[:])
+}
+
+// Reserve implements [ResumptionStore].
+func (s *KVResumptionStore) Reserve(ctx context.Context, token resumptionToken, hostID string, ttl time.Duration) error {
+	key := kvKey(token)
+	if existing, ok, err := s.kv.Get(ctx, key); err != nil {
+		return trace.Wrap(err, "checking existing token owner")
+	} else if ok && string(existing) != hostID {
+		return trace.AlreadyExists("resumption token already owned by host %q", existing)
+	}
+	return trace.Wrap(s.kv.Put(ctx, key, []byte(hostID), ttl), "reserving resumption token")
+}
+
+// Claim implements [ResumptionStore].
+func (s *KVResumptionStore) Claim(ctx context.Context, token resumptionToken) (string, bool, error) {
+	value, ok, err := s.kv.Get(ctx, kvKey(token))
+	if err != nil {
+		return "", false, trace.Wrap(err, "looking up resumption token owner")
+	}
+	if !ok {
+		return "", false, nil
+	}
+	return string(value), true, nil
+}
+
+// Release implements [ResumptionStore].
+func (s *KVResumptionStore) Release(ctx context.Context, token resumptionToken) error {
+	return trace.Wrap(s.kv.Delete(ctx, kvKey(token)), "releasing resumption token")
+}
+
+// TunnelDialer dials a resumption stream on another proxy replica, so that a
+// resumption attempt for a token owned by a different replica can be
+// reverse-tunneled there instead of failing. hostID identifies the owning
+// replica as recorded by a [ResumptionStore].
+type TunnelDialer interface {
+	// DialResumption opens a connection to the proxy replica identified by
+	// hostID, to which the raw resumption exchange bytes can be forwarded.
+	DialResumption(ctx context.Context, hostID string) (net.Conn, error)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sshutils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentChannelType is the channel opened back to the client to reach the
+// agent it offered to forward, per the OpenSSH agent forwarding extension.
+const agentChannelType = "auth-agent@openssh.com"
+
+// AgentForwardingCallback gates an "auth-agent-req@openssh.com" request,
+// letting operators disallow agent forwarding per-user/per-role before the
+// forwarding socket is ever created.
+type AgentForwardingCallback func(ctx Context) bool
+
+// SetAgentForwardingCallback installs cb to gate agent forwarding. Agent
+// forwarding is refused unless a callback is installed and returns true.
+func SetAgentForwardingCallback(cb AgentForwardingCallback) ServerOption {
+	return func(s *Server) error {
+		s.agentForwardingCallback = cb
+		return nil
+	}
+}
+
+// AgentFromSession dials sess's forwarded agent over a fresh
+// auth-agent@openssh.com channel, returning an agent.Agent that proxies to
+// it. sess must have received "auth-agent-req@openssh.com" and the
+// Server's AgentForwardingCallback must have allowed it.
+func AgentFromSession(sess Session) (agent.Agent, error) {
+	s, ok := sess.(*session)
+	if !ok {
+		return nil, fmt.Errorf("unsupported session implementation %T", sess)
+	}
+	if !s.agentForwarded {
+		return nil, fmt.Errorf("session did not request agent forwarding")
+	}
+
+	ch, reqs, err := s.sconn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return agent.NewClient(ch), nil
+}
+
+// setupAgentForwarding honors an "auth-agent-req@openssh.com" request: if
+// s.agentForwardingCallback allows it, it binds a unix socket under a
+// fresh per-session temp dir, exports it to the session as SSH_AUTH_SOCK,
+// and proxies every connection accepted on it to a fresh
+// auth-agent@openssh.com channel opened back on sess's connection. The
+// socket and its temp dir are removed once sess.doneCtx is canceled, i.e.
+// once this session channel closes - not when the underlying connection
+// does, so a long-lived multiplexed connection doesn't accumulate a leaked
+// socket/tempdir per session it's carried.
+func (s *Server) setupAgentForwarding(ctx Context, sess *session) bool {
+	if s.agentForwardingCallback == nil || !s.agentForwardingCallback(ctx) {
+		return false
+	}
+
+	dir, err := os.MkdirTemp("", "teleport-agent-")
+	if err != nil {
+		log.Errorf("agent forwarding: failed to create temp dir: %v", err)
+		return false
+	}
+
+	sockPath := filepath.Join(dir, "agent.sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		log.Errorf("agent forwarding: failed to listen on %v: %v", sockPath, err)
+		os.RemoveAll(dir)
+		return false
+	}
+	if err := os.Chmod(sockPath, 0600); err != nil {
+		log.Errorf("agent forwarding: failed to chmod %v: %v", sockPath, err)
+		ln.Close()
+		os.RemoveAll(dir)
+		return false
+	}
+
+	sess.agentForwarded = true
+	sess.env = append(sess.env, "SSH_AUTH_SOCK="+sockPath)
+
+	go func() {
+		<-sess.doneCtx.Done()
+		ln.Close()
+		os.RemoveAll(dir)
+	}()
+	go acceptAgentConns(sess.sconn, ln)
+
+	return true
+}
+
+// acceptAgentConns accepts connections on ln - made against the
+// SSH_AUTH_SOCK bind-mounted into a session - until it's closed, proxying
+// each one to a fresh auth-agent@openssh.com channel.
+func acceptAgentConns(sconn *ssh.ServerConn, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go proxyAgentConn(sconn, conn)
+	}
+}
+
+func proxyAgentConn(sconn *ssh.ServerConn, conn net.Conn) {
+	ch, reqs, err := sconn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	proxyChannelConn(ch, conn)
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sshutils
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// contextKey is the well-known key type used to store connection-scoped
+// values in a Context, modeled on gliderlabs/ssh's Context.
+type contextKey string
+
+const (
+	// ContextKeyUser holds the authenticated username (string).
+	ContextKeyUser = contextKey("user")
+	// ContextKeySessionID holds the SSH connection's session ID (string).
+	ContextKeySessionID = contextKey("session-id")
+	// ContextKeyClientVersion holds the client's advertised SSH version
+	// string (string).
+	ContextKeyClientVersion = contextKey("client-version")
+	// ContextKeyLocalAddr holds the connection's local net.Addr.
+	ContextKeyLocalAddr = contextKey("local-addr")
+	// ContextKeyRemoteAddr holds the connection's remote net.Addr.
+	ContextKeyRemoteAddr = contextKey("remote-addr")
+	// ContextKeyPermissions holds the *ssh.Permissions produced by the auth
+	// callback that accepted the connection.
+	ContextKeyPermissions = contextKey("permissions")
+	// ContextKeyServer holds the *Server handling the connection.
+	ContextKeyServer = contextKey("server")
+	// ContextKeyProxySource holds the real client net.Addr extracted from a
+	// PROXY protocol header, when a ConnWrapper provided one.
+	ContextKeyProxySource = contextKey("proxy-source")
+)
+
+// Context is a per-connection context.Context, canceled once the
+// connection terminates (or the Server is shut down), that also carries
+// well-known connection metadata for handlers that only have access to a
+// Context rather than the raw *ssh.ServerConn, the way gliderlabs/ssh's
+// Context does.
+type Context interface {
+	context.Context
+
+	// SetValue stores val under key for the lifetime of the connection.
+	SetValue(key, val interface{})
+
+	// User is a convenience accessor for ContextKeyUser.
+	User() string
+	// SessionID is a convenience accessor for ContextKeySessionID.
+	SessionID() string
+	// ClientVersion is a convenience accessor for ContextKeyClientVersion.
+	ClientVersion() string
+}
+
+// sshContext is the default implementation of Context.
+type sshContext struct {
+	context.Context
+
+	mu     sync.Mutex
+	values map[interface{}]interface{}
+}
+
+func newContext(srv *Server) (*sshContext, context.CancelFunc) {
+	inner, cancel := context.WithCancel(context.Background())
+	ctx := &sshContext{
+		Context: inner,
+		values:  make(map[interface{}]interface{}),
+	}
+	ctx.SetValue(ContextKeyServer, srv)
+	return ctx, cancel
+}
+
+// Value first consults the connection-scoped values set via SetValue before
+// falling back to the embedded context.Context, so that values set via
+// SetValue are visible even though they didn't originate from
+// context.WithValue.
+func (c *sshContext) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	v, ok := c.values[key]
+	c.mu.Unlock()
+	if ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *sshContext) SetValue(key, val interface{}) {
+	c.mu.Lock()
+	c.values[key] = val
+	c.mu.Unlock()
+}
+
+func (c *sshContext) User() string {
+	u, _ := c.Value(ContextKeyUser).(string)
+	return u
+}
+
+func (c *sshContext) SessionID() string {
+	id, _ := c.Value(ContextKeySessionID).(string)
+	return id
+}
+
+func (c *sshContext) ClientVersion() string {
+	v, _ := c.Value(ContextKeyClientVersion).(string)
+	return v
+}
+
+// applyConn populates ctx with the well-known values derived from sconn.
+func (c *sshContext) applyConn(sconn *ssh.ServerConn) {
+	c.SetValue(ContextKeyUser, sconn.User())
+	c.SetValue(ContextKeySessionID, string(sconn.SessionID()))
+	c.SetValue(ContextKeyClientVersion, string(sconn.ClientVersion()))
+	c.SetValue(ContextKeyLocalAddr, sconn.LocalAddr())
+	c.SetValue(ContextKeyRemoteAddr, sconn.RemoteAddr())
+	if sconn.Permissions != nil {
+		c.SetValue(ContextKeyPermissions, sconn.Permissions)
+	}
+}
+
+// ContextFor returns the Context associated with an active connection, so
+// that NewChanHandler implementations - whose signature predates Context and
+// so only ever receives the raw *ssh.ServerConn - can still observe
+// cancellation, shutdown, and connection metadata without breaking
+// compatibility. RequestHandler receives only the *ssh.Request, so it has no
+// connection to look up here.
+func (s *Server) ContextFor(sconn *ssh.ServerConn) Context {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return s.conns[sconn]
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sshutils
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Dialer dials port-forwarding destinations; satisfied by *net.Dialer.
+// It's an interface rather than a concrete type so tests and callers that
+// need to restrict or proxy forwarding destinations can substitute their
+// own.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// SetForwardingDialer overrides the Dialer used to satisfy direct-tcpip
+// (local port forwarding) requests. Defaults to &net.Dialer{}.
+func SetForwardingDialer(d Dialer) ServerOption {
+	return func(s *Server) error {
+		s.forwardingDialer = d
+		return nil
+	}
+}
+
+// LocalPortForwardingCallback gates a "direct-tcpip" request (local port
+// forwarding, e.g. `ssh -L`) for the given destination. Forwarding is
+// denied unless a callback is installed and returns true.
+type LocalPortForwardingCallback func(ctx Context, destHost string, destPort uint32) bool
+
+// SetLocalPortForwardingCallback installs cb to gate local port forwarding.
+func SetLocalPortForwardingCallback(cb LocalPortForwardingCallback) ServerOption {
+	return func(s *Server) error {
+		s.localForwardingCallback = cb
+		return nil
+	}
+}
+
+// ReversePortForwardingCallback gates a "tcpip-forward" request (reverse
+// port forwarding, e.g. `ssh -R`) for the given bind address. Forwarding is
+// denied unless a callback is installed and returns true.
+type ReversePortForwardingCallback func(ctx Context, bindHost string, bindPort uint32) bool
+
+// SetReversePortForwardingCallback installs cb to gate reverse port
+// forwarding.
+func SetReversePortForwardingCallback(cb ReversePortForwardingCallback) ServerOption {
+	return func(s *Server) error {
+		s.reverseForwardingCallback = cb
+		return nil
+	}
+}
+
+// directTCPIPReq is the RFC 4254 7.2 "direct-tcpip" channel open payload.
+type directTCPIPReq struct {
+	DestHost   string
+	DestPort   uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// handleDirectTCPIP services a "direct-tcpip" channel (local port
+// forwarding): it dials the requested destination via s.forwardingDialer
+// and proxies bytes bidirectionally once s.localForwardingCallback allows
+// it.
+func (s *Server) handleDirectTCPIP(ctx Context, nch ssh.NewChannel) {
+	var req directTCPIPReq
+	if err := ssh.Unmarshal(nch.ExtraData(), &req); err != nil {
+		nch.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+
+	if s.localForwardingCallback == nil || !s.localForwardingCallback(ctx, req.DestHost, req.DestPort) {
+		nch.Reject(ssh.Prohibited, "port forwarding is not permitted")
+		return
+	}
+
+	dialer := s.forwardingDialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	dest := net.JoinHostPort(req.DestHost, strconv.Itoa(int(req.DestPort)))
+	conn, err := dialer.DialContext(ctx, "tcp", dest)
+	if err != nil {
+		nch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	proxyChannelConn(ch, conn)
+}
+
+// proxyChannelConn copies bytes bidirectionally between an SSH channel and
+// a net.Conn, half-closing each side as its copy direction finishes so the
+// other direction can still drain, and closes both ends once both
+// directions are done.
+func proxyChannelConn(ch ssh.Channel, conn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, ch)
+		if half, ok := conn.(interface{ CloseWrite() error }); ok {
+			half.CloseWrite()
+		}
+	}()
+
+	wg.Wait()
+	ch.Close()
+	conn.Close()
+}
+
+// tcpipForwardMsg is the RFC 4254 7.1 "tcpip-forward"/"cancel-tcpip-forward"
+// global request payload.
+type tcpipForwardMsg struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// tcpipForwardReply is the "tcpip-forward" success reply payload, carrying
+// back the bound port when the client requested port 0.
+type tcpipForwardReply struct {
+	BoundPort uint32
+}
+
+// forwardedTCPIPMsg is the RFC 4254 7.2 "forwarded-tcpip" channel open
+// payload.
+type forwardedTCPIPMsg struct {
+	ConnHost   string
+	ConnPort   uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// forwardKey identifies one reverse-forwarding listener within a
+// connection.
+type forwardKey struct {
+	bindAddr string
+	bindPort uint32
+}
+
+// reverseForwards tracks the net.Listeners opened by tcpip-forward, per
+// originating *ssh.ServerConn, so cancel-tcpip-forward and connection
+// teardown can close exactly the right ones without leaking the rest.
+type reverseForwards struct {
+	mu        sync.Mutex
+	listeners map[*ssh.ServerConn]map[forwardKey]net.Listener
+}
+
+func newReverseForwards() *reverseForwards {
+	return &reverseForwards{listeners: make(map[*ssh.ServerConn]map[forwardKey]net.Listener)}
+}
+
+func (r *reverseForwards) add(sconn *ssh.ServerConn, key forwardKey, ln net.Listener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.listeners[sconn] == nil {
+		r.listeners[sconn] = make(map[forwardKey]net.Listener)
+	}
+	r.listeners[sconn][key] = ln
+}
+
+func (r *reverseForwards) remove(sconn *ssh.ServerConn, key forwardKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ln, ok := r.listeners[sconn][key]
+	if !ok {
+		return false
+	}
+	delete(r.listeners[sconn], key)
+	ln.Close()
+	return true
+}
+
+// closeAll closes every listener opened by sconn; called when the
+// connection terminates so a client that disconnects without sending
+// cancel-tcpip-forward doesn't leak a listener.
+func (r *reverseForwards) closeAll(sconn *ssh.ServerConn) {
+	r.mu.Lock()
+	lns := r.listeners[sconn]
+	delete(r.listeners, sconn)
+	r.mu.Unlock()
+
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// handleTCPIPForward starts listening for a "tcpip-forward" global request
+// and accepts connections on it for the lifetime of sconn (or until
+// cancel-tcpip-forward), opening a "forwarded-tcpip" channel back to the
+// client for each one.
+func (s *Server) handleTCPIPForward(ctx Context, sconn *ssh.ServerConn, req *ssh.Request) {
+	var m tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &m); err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	if s.reverseForwardingCallback == nil || !s.reverseForwardingCallback(ctx, m.BindAddr, m.BindPort) {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(m.BindAddr, strconv.Itoa(int(m.BindPort))))
+	if err != nil {
+		log.Errorf("tcpip-forward: listen on %s:%d failed: %v", m.BindAddr, m.BindPort, err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	_, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	s.forwards.add(sconn, forwardKey{bindAddr: m.BindAddr, bindPort: uint32(port)}, ln)
+
+	if req.WantReply {
+		req.Reply(true, ssh.Marshal(&tcpipForwardReply{BoundPort: uint32(port)}))
+	}
+
+	go s.acceptForwarded(sconn, m.BindAddr, ln)
+}
+
+func (s *Server) acceptForwarded(sconn *ssh.ServerConn, bindAddr string, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.forwardAccepted(sconn, bindAddr, conn)
+	}
+}
+
+func (s *Server) forwardAccepted(sconn *ssh.ServerConn, bindAddr string, conn net.Conn) {
+	originHost, originPortStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	originPort, _ := strconv.Atoi(originPortStr)
+	_, connPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
+	connPort, _ := strconv.Atoi(connPortStr)
+
+	payload := ssh.Marshal(&forwardedTCPIPMsg{
+		ConnHost:   bindAddr,
+		ConnPort:   uint32(connPort),
+		OriginHost: originHost,
+		OriginPort: uint32(originPort),
+	})
+
+	ch, reqs, err := sconn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	proxyChannelConn(ch, conn)
+}
+
+// handleCancelTCPIPForward stops and forgets the listener matching a
+// "cancel-tcpip-forward" global request, if one is tracked for sconn.
+func (s *Server) handleCancelTCPIPForward(sconn *ssh.ServerConn, req *ssh.Request) {
+	var m tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &m); err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	ok := s.forwards.remove(sconn, forwardKey{bindAddr: m.BindAddr, bindPort: m.BindPort})
+	if req.WantReply {
+		req.Reply(ok, nil)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sshutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ConnWrapper optionally replaces an accepted net.Conn before the SSH
+// handshake begins, e.g. to terminate a PROXY protocol header and recover
+// the real client address behind an L4 load balancer. Returning an error
+// causes the connection to be closed without a handshake attempt.
+type ConnWrapper func(net.Conn) (net.Conn, error)
+
+// SetConnWrapper installs w to run on every accepted connection before the
+// SSH handshake begins.
+func SetConnWrapper(w ConnWrapper) ServerOption {
+	return func(s *Server) error {
+		s.connWrapper = w
+		return nil
+	}
+}
+
+// ProxySourceConn is implemented by a net.Conn returned from a ConnWrapper
+// that recovered a real client address distinct from its transport
+// RemoteAddr, e.g. via a PROXY protocol header. handleConnection stores it
+// in the connection's Context under ContextKeyProxySource.
+type ProxySourceConn interface {
+	net.Conn
+
+	// ProxySource is the real client address the wrapper recovered.
+	ProxySource() net.Addr
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// NewProxyProtocolWrapper returns a ConnWrapper that terminates a PROXY
+// protocol v1 or v2 header (HAProxy's protocol for passing a client's real
+// address through an L4 load balancer), replacing RemoteAddr() on the
+// returned conn with the address it carries. A connection from a source
+// outside trustedCIDRs is rejected if it carries a header at all, so an
+// end user can't spoof their own address by sending one.
+func NewProxyProtocolWrapper(trustedCIDRs []*net.IPNet) ConnWrapper {
+	return func(conn net.Conn) (net.Conn, error) {
+		br := bufio.NewReader(conn)
+
+		sig, err := br.Peek(len(proxyV2Signature))
+		hasV2 := err == nil && bytes.Equal(sig, proxyV2Signature)
+
+		line, err := br.Peek(6)
+		hasV1 := err == nil && bytes.Equal(line, []byte("PROXY "))
+
+		if !hasV2 && !hasV1 {
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+
+		if !connSourceTrusted(conn, trustedCIDRs) {
+			return nil, fmt.Errorf("proxy protocol header from untrusted source %v", conn.RemoteAddr())
+		}
+
+		if hasV2 {
+			return parseProxyV2(conn, br)
+		}
+		return parseProxyV1(conn, br)
+	}
+}
+
+func connSourceTrusted(conn net.Conn, trustedCIDRs []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range trustedCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn wraps a net.Conn whose first bytes were already consumed
+// into a bufio.Reader (e.g. while probing for a PROXY protocol header), so
+// that Read continues from the buffered data rather than dropping it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// proxyConn wraps a net.Conn whose RemoteAddr has been overridden with the
+// address recovered from a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) ProxySource() net.Addr {
+	return c.remoteAddr
+}
+
+// parseProxyV1 parses the PROXY protocol v1 text header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func parseProxyV1(conn net.Conn, br *bufio.Reader) (net.Conn, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: %v", err)
+	}
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("proxy protocol v1: malformed header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("proxy protocol v1: malformed header %q", line)
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	srcPort, err := strconv.Atoi(fields[4])
+	if srcIP == nil || err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: malformed source address %q", line)
+	}
+
+	return &proxyConn{
+		Conn:       conn,
+		r:          br,
+		remoteAddr: &net.TCPAddr{IP: srcIP, Port: srcPort},
+	}, nil
+}
+
+const (
+	proxyV2CmdLocal = 0x0
+	proxyV2FamInet  = 0x1
+	proxyV2FamInet6 = 0x2
+)
+
+// parseProxyV2 parses the PROXY protocol v2 binary header.
+func parseProxyV2(conn net.Conn, br *bufio.Reader) (net.Conn, error) {
+	if _, err := br.Discard(len(proxyV2Signature)); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %v", err)
+	}
+
+	verCmd, err := br.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %v", err)
+	}
+	famProto, err := br.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %v", err)
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(br, lenBuf[:]); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %v", err)
+	}
+	addrLen := binary.BigEndian.Uint16(lenBuf[:])
+
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(br, addr); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %v", err)
+	}
+
+	cmd := verCmd & 0x0f
+	if cmd == proxyV2CmdLocal {
+		// LOCAL: health check / keepalive from the proxy itself, not a
+		// proxied client; the address block carries no useful source.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	family := famProto >> 4
+	var srcIP net.IP
+	var srcPort int
+
+	switch family {
+	case proxyV2FamInet:
+		if len(addr) < 12 {
+			return nil, fmt.Errorf("proxy protocol v2: short ipv4 address block")
+		}
+		srcIP = net.IP(addr[0:4])
+		srcPort = int(binary.BigEndian.Uint16(addr[8:10]))
+	case proxyV2FamInet6:
+		if len(addr) < 36 {
+			return nil, fmt.Errorf("proxy protocol v2: short ipv6 address block")
+		}
+		srcIP = net.IP(addr[0:16])
+		srcPort = int(binary.BigEndian.Uint16(addr[32:34]))
+	default:
+		return nil, fmt.Errorf("proxy protocol v2: unsupported address family %#x", family)
+	}
+
+	return &proxyConn{
+		Conn:       conn,
+		r:          br,
+		remoteAddr: &net.TCPAddr{IP: srcIP, Port: srcPort},
+	}, nil
+}
@@ -5,7 +5,7 @@ Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
 You may obtain a copy of the License at
 
-    http://www.apache.org/licenses/LICENSE-2.0
+	http://www.apache.org/licenses/LICENSE-2.0
 
 Unless required by applicable law or agreed to in writing, software
 distributed under the License is distributed on an "AS IS" BASIS,
@@ -34,8 +34,28 @@ type Server struct {
 	closeC         chan struct{}
 	newChanHandler NewChanHandler
 	reqHandler     RequestHandler
+	sessionHandler func(Session)
 	cfg            ssh.ServerConfig
 	limiter        *limiter.Limiter
+
+	connsMu sync.Mutex
+	conns   map[*ssh.ServerConn]Context
+
+	stateHook func(net.Conn, ConnState)
+	connsWG   sync.WaitGroup
+
+	trackMu sync.Mutex
+	tracked map[uint64]*trackedConn
+	nextID  uint64
+
+	localForwardingCallback   LocalPortForwardingCallback
+	reverseForwardingCallback ReversePortForwardingCallback
+	forwardingDialer          Dialer
+	forwards                  *reverseForwards
+
+	agentForwardingCallback AgentForwardingCallback
+
+	connWrapper ConnWrapper
 }
 
 type ServerOption func(cfg *Server) error
@@ -50,6 +70,9 @@ func NewServer(a utils.NetAddr, h NewChanHandler, hostSigners []ssh.Signer,
 		newChanHandler: h,
 		closeC:         make(chan struct{}),
 		limiter:        limiter,
+		conns:          make(map[*ssh.ServerConn]Context),
+		tracked:        make(map[uint64]*trackedConn),
+		forwards:       newReverseForwards(),
 	}
 	for _, o := range opts {
 		if err := o(s); err != nil {
@@ -98,12 +121,19 @@ func (s *Server) notifyClosed() {
 	close(s.closeC)
 }
 
+// Wait blocks until the listener has stopped accepting connections and
+// every connection it handed off has finished being served.
 func (s *Server) Wait() {
 	<-s.closeC
+	s.connsWG.Wait()
 }
 
-// Close closes listening socket and stops accepting connections
+// Close closes listening socket and stops accepting connections. It's a
+// no-op if Start was never called.
 func (s *Server) Close() error {
+	if s.l == nil {
+		return nil
+	}
 	return s.l.Close()
 }
 
@@ -127,10 +157,41 @@ func (s *Server) acceptConnections() {
 	}
 }
 
+// connWrapTimeout bounds how long a ConnWrapper (e.g. the PROXY protocol
+// header parser) may block reading from a freshly accepted connection,
+// so a client that opens a connection and never sends a byte can't hang
+// the goroutine serving it forever.
+const connWrapTimeout = 30 * time.Second
+
 func (s *Server) handleConnection(conn net.Conn) {
 	// initiate an SSH connection, note that we don't need to close the conn here
 	// in case of error as ssh server takes care of this
 
+	s.connsWG.Add(1)
+	defer s.connsWG.Done()
+
+	tc := s.trackNew(conn)
+	defer s.untrack(tc)
+
+	if s.connWrapper != nil {
+		if err := conn.SetReadDeadline(time.Now().Add(connWrapTimeout)); err != nil {
+			log.Errorf(err.Error())
+		}
+		wrapped, err := s.connWrapper(conn)
+		if err != nil {
+			log.Errorf("rejecting connection from %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		if err := wrapped.SetReadDeadline(time.Time{}); err != nil {
+			log.Errorf(err.Error())
+		}
+		conn = wrapped
+		s.trackMu.Lock()
+		tc.conn = conn
+		s.trackMu.Unlock()
+	}
+
 	remoteAddr, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
 		log.Errorf(err.Error())
@@ -169,34 +230,68 @@ func (s *Server) handleConnection(conn net.Conn) {
 	log.Infof("new ssh connection %v -> %v vesion: %v",
 		sconn.RemoteAddr(), sconn.LocalAddr(), string(sconn.ClientVersion()))
 
+	ctx, cancel := newContext(s)
+	ctx.applyConn(sconn)
+	if psc, ok := conn.(ProxySourceConn); ok {
+		ctx.SetValue(ContextKeyProxySource, psc.ProxySource())
+	}
+	s.connsMu.Lock()
+	s.conns[sconn] = ctx
+	s.connsMu.Unlock()
+	defer func() {
+		cancel()
+		s.connsMu.Lock()
+		delete(s.conns, sconn)
+		s.connsMu.Unlock()
+	}()
+
+	s.trackActive(tc, sconn, cancel)
+	defer s.forwards.closeAll(sconn)
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
 		// Handle incoming out-of-band Requests
-		s.handleRequests(reqs)
+		s.handleRequests(ctx, sconn, reqs)
 		wg.Done()
 	}()
 	go func() {
 		// Handle channel requests on this connections
-		s.handleChannels(sconn, chans)
+		s.handleChannels(ctx, sconn, chans)
 		wg.Done()
 	}()
 
 	wg.Wait()
 }
 
-func (s *Server) handleRequests(reqs <-chan *ssh.Request) {
+func (s *Server) handleRequests(ctx Context, sconn *ssh.ServerConn, reqs <-chan *ssh.Request) {
 	for req := range reqs {
 		log.Infof("recieved out-of-band request: %+v", req)
+		switch req.Type {
+		case "tcpip-forward":
+			s.handleTCPIPForward(ctx, sconn, req)
+			continue
+		case "cancel-tcpip-forward":
+			s.handleCancelTCPIPForward(sconn, req)
+			continue
+		}
 		if s.reqHandler != nil {
 			s.reqHandler.HandleRequest(req)
 		}
 	}
 }
 
-func (s *Server) handleChannels(sconn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+func (s *Server) handleChannels(ctx Context, sconn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
 	for nch := range chans {
+		switch {
+		case s.sessionHandler != nil && nch.ChannelType() == "session":
+			go s.handleSessionChannel(ctx, sconn, nch)
+			continue
+		case nch.ChannelType() == "direct-tcpip":
+			go s.handleDirectTCPIP(ctx, nch)
+			continue
+		}
 		s.newChanHandler.HandleNewChan(sconn, nch)
 	}
 }
@@ -0,0 +1,310 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sshutils
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	shlex "github.com/anmitsu/go-shlex"
+	"golang.org/x/crypto/ssh"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Window represents the dimensions of a terminal.
+type Window struct {
+	Width  int
+	Height int
+}
+
+// Pty describes a pseudo-terminal requested via a "pty-req" request.
+type Pty struct {
+	Term   string
+	Window Window
+}
+
+// Session is a higher-level view of an SSH "session" channel: it decodes
+// the "pty-req"/"shell"/"exec"/"subsystem"/"env"/"window-change" requests
+// that every session channel handler would otherwise have to parse by hand,
+// the way gliderlabs/ssh's Session does.
+type Session interface {
+	ssh.Channel
+
+	// User is the username the underlying connection authenticated as.
+	User() string
+	// RemoteAddr is the remote address of the underlying connection.
+	RemoteAddr() net.Addr
+	// Environ returns the "name=value" pairs sent via "env" requests, in
+	// the order they were received.
+	Environ() []string
+	// Command is the shlex-split "exec" command line, or nil for an
+	// interactive shell or subsystem session.
+	Command() []string
+	// Subsystem is the name requested via "subsystem", or "" if none was
+	// requested.
+	Subsystem() string
+	// Pty returns the pty requested via "pty-req" (if any), a channel
+	// delivering subsequent "window-change" events, and whether a pty was
+	// requested at all.
+	Pty() (Pty, <-chan Window, bool)
+	// Exit sends the given process exit status to the client and closes
+	// the session channel.
+	Exit(code int) error
+	// Context returns the context of the underlying connection.
+	Context() Context
+}
+
+// SetSessionHandler installs fn as the handler for "session" channels. The
+// Server accepts the channel, handles the pty/env/window-change/shell/
+// exec/subsystem requests itself, and invokes fn once the session is ready
+// to use. NewChanHandler is still consulted for every channel type other
+// than "session" and "direct-tcpip" (which the Server handles itself), so
+// callers can migrate from it to Session incrementally.
+func SetSessionHandler(fn func(Session)) ServerOption {
+	return func(s *Server) error {
+		s.sessionHandler = fn
+		return nil
+	}
+}
+
+// session is the default implementation of Session.
+type session struct {
+	ssh.Channel
+
+	ctx   Context
+	sconn *ssh.ServerConn
+
+	// doneCtx is canceled once this session channel closes, scoped to this
+	// session alone (unlike ctx, which lives for the whole connection); it's
+	// what setupAgentForwarding watches to clean up the session's forwarded
+	// agent socket promptly on a multiplexed connection.
+	doneCtx context.Context
+
+	user       string
+	remoteAddr net.Addr
+
+	env       []string
+	cmd       []string
+	subsystem string
+
+	pty   Pty
+	ptyOk bool
+	winCh chan Window
+
+	agentForwarded bool
+
+	startOnce sync.Once
+}
+
+func (s *session) User() string         { return s.user }
+func (s *session) RemoteAddr() net.Addr { return s.remoteAddr }
+func (s *session) Environ() []string    { return s.env }
+func (s *session) Command() []string    { return s.cmd }
+func (s *session) Subsystem() string    { return s.subsystem }
+func (s *session) Context() Context     { return s.ctx }
+
+func (s *session) Pty() (Pty, <-chan Window, bool) {
+	return s.pty, s.winCh, s.ptyOk
+}
+
+func (s *session) Exit(code int) error {
+	_, err := s.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// handleSessionChannel accepts a "session" channel and services its
+// requests until the client closes it, dispatching to s.sessionHandler
+// once a shell/exec/subsystem request starts the session proper.
+func (s *Server) handleSessionChannel(ctx Context, sconn *ssh.ServerConn, nch ssh.NewChannel) {
+	ch, reqs, err := nch.Accept()
+	if err != nil {
+		log.Errorf("failed to accept session channel: %v", err)
+		return
+	}
+
+	doneCtx, done := context.WithCancel(ctx)
+	defer done()
+
+	sess := &session{
+		Channel:    ch,
+		ctx:        ctx,
+		doneCtx:    doneCtx,
+		sconn:      sconn,
+		user:       sconn.User(),
+		remoteAddr: sconn.RemoteAddr(),
+		winCh:      make(chan Window, 1),
+	}
+
+	start := func() {
+		sess.startOnce.Do(func() {
+			go func() {
+				defer ch.Close()
+				s.sessionHandler(sess)
+			}()
+		})
+	}
+
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			pty, ok := parsePtyRequest(req.Payload)
+			if ok {
+				sess.pty = pty
+				sess.ptyOk = true
+			}
+			if req.WantReply {
+				req.Reply(ok, nil)
+			}
+		case "window-change":
+			win, ok := parseWindowChange(req.Payload)
+			if ok {
+				sess.pty.Window = win
+				select {
+				case sess.winCh <- win:
+				default:
+				}
+			}
+			// window-change requests never carry WantReply per RFC 4254 6.7.
+		case "env":
+			name, value, ok := parseEnvRequest(req.Payload)
+			if ok {
+				sess.env = append(sess.env, name+"="+value)
+			}
+			if req.WantReply {
+				req.Reply(ok, nil)
+			}
+		case "auth-agent-req@openssh.com":
+			ok := s.setupAgentForwarding(ctx, sess)
+			if req.WantReply {
+				req.Reply(ok, nil)
+			}
+		case "shell":
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+			start()
+		case "exec":
+			cmd, ok := parseExecRequest(req.Payload)
+			if ok {
+				sess.cmd = cmd
+			}
+			if req.WantReply {
+				req.Reply(ok, nil)
+			}
+			if ok {
+				start()
+			}
+		case "subsystem":
+			name, ok := parseSubsystemRequest(req.Payload)
+			if ok {
+				sess.subsystem = name
+			}
+			if req.WantReply {
+				req.Reply(ok, nil)
+			}
+			if ok {
+				start()
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+func parsePtyRequest(payload []byte) (Pty, bool) {
+	var msg ptyRequestMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return Pty{}, false
+	}
+	return Pty{
+		Term:   msg.Term,
+		Window: Window{Width: int(msg.Columns), Height: int(msg.Rows)},
+	}, true
+}
+
+type windowChangeMsg struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+func parseWindowChange(payload []byte) (Window, bool) {
+	var msg windowChangeMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return Window{}, false
+	}
+	return Window{Width: int(msg.Columns), Height: int(msg.Rows)}, true
+}
+
+type envRequestMsg struct {
+	Name  string
+	Value string
+}
+
+func parseEnvRequest(payload []byte) (name, value string, ok bool) {
+	var msg envRequestMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return "", "", false
+	}
+	return msg.Name, msg.Value, true
+}
+
+type execRequestMsg struct {
+	Command string
+}
+
+// parseExecRequest shlex-splits the "exec" command line the same way a
+// login shell would, so handlers get an argv rather than a raw string.
+func parseExecRequest(payload []byte) ([]string, bool) {
+	var msg execRequestMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return nil, false
+	}
+	words, err := shlex.Split(msg.Command, true)
+	if err != nil {
+		return nil, false
+	}
+	return words, true
+}
+
+type subsystemRequestMsg struct {
+	Name string
+}
+
+func parseSubsystemRequest(payload []byte) (string, bool) {
+	var msg subsystemRequestMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return "", false
+	}
+	return msg.Name, true
+}
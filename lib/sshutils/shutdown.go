@@ -0,0 +1,158 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package sshutils
+
+import (
+	"context"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnState is the lifecycle state of a connection tracked by Server,
+// reported to a ConnectionStateHook.
+type ConnState int
+
+const (
+	// StateNew is a connection that has just been accepted; the SSH
+	// handshake has not completed yet.
+	StateNew ConnState = iota
+	// StateActive is a connection whose SSH handshake completed
+	// successfully and that is now being served.
+	StateActive
+	// StateClosed is a connection that has finished being served, whether
+	// it closed cleanly or was torn down by Shutdown.
+	StateClosed
+)
+
+func (cs ConnState) String() string {
+	switch cs {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectionStateHook installs fn to be called every time a tracked
+// connection transitions between StateNew, StateActive, and StateClosed.
+func ConnectionStateHook(fn func(net.Conn, ConnState)) ServerOption {
+	return func(s *Server) error {
+		s.stateHook = fn
+		return nil
+	}
+}
+
+// trackedConn is Server's bookkeeping entry for a single accepted
+// connection, from Accept through SSH handshake to teardown.
+type trackedConn struct {
+	id     uint64
+	conn   net.Conn
+	sconn  *ssh.ServerConn
+	cancel context.CancelFunc
+}
+
+// trackNew registers a freshly-accepted connection and reports StateNew.
+func (s *Server) trackNew(conn net.Conn) *trackedConn {
+	s.trackMu.Lock()
+	s.nextID++
+	tc := &trackedConn{id: s.nextID, conn: conn}
+	s.tracked[tc.id] = tc
+	s.trackMu.Unlock()
+
+	if s.stateHook != nil {
+		s.stateHook(conn, StateNew)
+	}
+	return tc
+}
+
+// trackActive records that tc's SSH handshake completed and reports
+// StateActive. cancel is tc's connection Context's cancel func, so Shutdown
+// can unblock its handlers.
+func (s *Server) trackActive(tc *trackedConn, sconn *ssh.ServerConn, cancel context.CancelFunc) {
+	s.trackMu.Lock()
+	tc.sconn = sconn
+	tc.cancel = cancel
+	s.trackMu.Unlock()
+
+	if s.stateHook != nil {
+		s.stateHook(tc.conn, StateActive)
+	}
+}
+
+// untrack removes tc from the live set and reports StateClosed.
+func (s *Server) untrack(tc *trackedConn) {
+	s.trackMu.Lock()
+	delete(s.tracked, tc.id)
+	s.trackMu.Unlock()
+
+	if s.stateHook != nil {
+		s.stateHook(tc.conn, StateClosed)
+	}
+}
+
+// ConnCount returns the number of connections currently tracked, from
+// acceptance through teardown.
+func (s *Server) ConnCount() int {
+	s.trackMu.Lock()
+	defer s.trackMu.Unlock()
+	return len(s.tracked)
+}
+
+// Shutdown stops accepting new connections, cancels the Context of every
+// tracked connection so in-flight handlers can wind down, and blocks until
+// every connection finishes or ctx expires - at which point any that are
+// still open are hard-closed. It's safe to call even if Start was never
+// called or the listener is already closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.Close(); err != nil {
+		log.Debugf("shutdown: listener close: %v", err)
+	}
+
+	s.trackMu.Lock()
+	for _, tc := range s.tracked {
+		if tc.cancel != nil {
+			tc.cancel()
+		}
+	}
+	s.trackMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.connsWG.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.trackMu.Lock()
+		for _, tc := range s.tracked {
+			if tc.sconn != nil {
+				tc.sconn.Close()
+			}
+			tc.conn.Close()
+		}
+		s.trackMu.Unlock()
+		return ctx.Err()
+	}
+}